@@ -0,0 +1,176 @@
+package main
+
+// Usage:
+//
+//	admin [-daemon addr] listbans
+//	admin [-daemon addr] clearbans [host]
+//	admin [-daemon addr] generate n (on regtest)
+//	admin [-daemon addr] startmining [workers]
+//	admin [-daemon addr] stopmining
+//	admin [-daemon addr] mininginfo
+//	admin [-daemon addr] setpayout key... (saved only if the daemon has -payoutfile)
+//	admin [-daemon addr] getpayout
+//	admin [-daemon addr] getmempool
+//	admin [-daemon addr] getmempoolentry hash
+//	admin [-daemon addr] mempoolinfo
+//	admin [-daemon addr] watchmempool
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os-project/SophiaCoin/pkg/chaincfg"
+	"strconv"
+	"time"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	daemon  = flag.String("daemon", "", "The address of the daemon, which must run on this host, 127.0.0.1 at the default port of the network if empty")
+	network = flag.String("network", "mainnet", "The network of the daemon: mainnet, testnet or regtest")
+)
+
+func main() {
+	flag.Parse()
+	if *daemon == "" {
+		params, err := chaincfg.Get(*network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*daemon = net.JoinHostPort("127.0.0.1", params.DefaultPort)
+	}
+
+	conn, err := grpc.Dial(*daemon, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("failed to connect to %s: %v", *daemon, err)
+	}
+	defer conn.Close()
+	admin := pb.NewAdminServiceClient(conn)
+	node := pb.NewBroadcastServiceClient(conn)
+
+	switch flag.Arg(0) {
+	case "listbans":
+		bans, err := admin.ListBans(context.Background(), &empty.Empty{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, ban := range bans.Bans {
+			fmt.Printf("%s\tuntil %v\t%s\n", ban.Host, time.Unix(ban.Until, 0).Format(time.DateTime), ban.Reason)
+		}
+	case "clearbans":
+		_, err := admin.ClearBans(context.Background(), &pb.ClearBansRequest{Host: flag.Arg(1)})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "generate":
+		blocks, err := strconv.ParseUint(flag.Arg(1), 10, 32)
+		if err != nil {
+			log.Fatalf("invalid number of blocks %q", flag.Arg(1))
+		}
+		hashes, err := admin.Generate(context.Background(), &pb.GenerateRequest{Blocks: uint32(blocks)})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, hash := range hashes.Hashes {
+			fmt.Printf("%x\n", hash)
+		}
+	case "startmining", "stopmining", "mininginfo":
+		var info *pb.MiningInfo
+		switch flag.Arg(0) {
+		case "startmining":
+			workers, _ := strconv.ParseUint(flag.Arg(1), 10, 32)
+			info, err = admin.StartMining(context.Background(), &pb.MiningRequest{Workers: uint32(workers)})
+		case "stopmining":
+			info, err = admin.StopMining(context.Background(), &empty.Empty{})
+		default:
+			info, err = admin.GetMiningInfo(context.Background(), &empty.Empty{})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("running: %v\nworkers: %d\nhash rate: %d H/s\nheight: %d\ndifficulty: %d\n",
+			info.Running, info.Workers, info.HashRate, info.Height, info.Difficulty)
+	case "setpayout", "getpayout":
+		var keys *pb.PayoutKeys
+		if flag.Arg(0) == "setpayout" {
+			request := &pb.PayoutKeys{}
+			for _, arg := range flag.Args()[1:] {
+				key, err := hex.DecodeString(arg)
+				if err != nil {
+					log.Fatalf("invalid payout key %q", arg)
+				}
+				request.Keys = append(request.Keys, key)
+			}
+			keys, err = admin.SetPayoutKeys(context.Background(), request)
+		} else {
+			keys, err = admin.GetPayoutKeys(context.Background(), &empty.Empty{})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range keys.Keys {
+			fmt.Printf("%x\n", key)
+		}
+	case "getmempool":
+		entries, err := node.GetMempool(context.Background(), &empty.Empty{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries.Entries {
+			printMempoolEntry(entry)
+		}
+	case "getmempoolentry":
+		hash, err := hex.DecodeString(flag.Arg(1))
+		if err != nil {
+			log.Fatalf("invalid hash %q", flag.Arg(1))
+		}
+		entry, err := node.GetMempoolEntry(context.Background(), &pb.MempoolEntryRequest{Hash: hash})
+		if err != nil {
+			log.Fatal(err)
+		}
+		printMempoolEntry(entry)
+		for _, depend := range entry.Depends {
+			fmt.Printf("depends on %x\n", depend)
+		}
+		fmt.Printf("%x\n", entry.Transaction)
+	case "mempoolinfo":
+		info, err := node.GetMempoolInfo(context.Background(), &empty.Empty{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("transactions: %d\nsize: %d/%d bytes\ntotal fee: %d\nmin relay fee: %d per 1000 bytes\n",
+			info.Count, info.Size, info.MaxSize, info.TotalFee, info.MinRelayFee)
+	case "watchmempool":
+		stream, err := node.SubscribeMempool(context.Background(), &empty.Empty{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if event.Type == pb.MempoolEventType_TX_ADDED {
+				fmt.Print("added\t")
+			} else {
+				fmt.Printf("removed (%s)\t", event.Reason)
+			}
+			printMempoolEntry(event.Entry)
+		}
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+}
+
+func printMempoolEntry(entry *pb.MempoolEntry) {
+	age := time.Since(time.Unix(entry.Added, 0)).Round(time.Second)
+	fmt.Printf("%x\tfee %d\tsize %d\tage %v\n", entry.Hash, entry.Fee, entry.Size, age)
+}
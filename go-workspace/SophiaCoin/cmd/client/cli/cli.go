@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"os-project/SophiaCoin/pkg/crypto"
 	"os-project/SophiaCoin/pkg/wallet"
+	"sort"
 	"strconv"
 	"time"
 
@@ -34,6 +36,7 @@ const (
 	STATE_KEY_PUBSAVE
 
 	STATE_PAY
+	STATE_BUMP_FEE
 
 	STATE_BILL
 	STATE_BILL_SAVE
@@ -101,6 +104,7 @@ func (cli *Cli) main() {
 				[]string{
 					"Key Management",
 					"Payment",
+					"Bump the fee of a payment",
 					"Billings",
 					"Exit",
 				},
@@ -120,8 +124,10 @@ func (cli *Cli) main() {
 			case 1:
 				cli.state = STATE_PAY
 			case 2:
-				cli.state = STATE_BILL
+				cli.state = STATE_BUMP_FEE
 			case 3:
+				cli.state = STATE_BILL
+			case 4:
 				exit()
 			}
 		case STATE_KEY:
@@ -256,6 +262,10 @@ func (cli *Cli) main() {
 			cli.pay()
 			cli.state = STATE_INIT
 
+		case STATE_BUMP_FEE:
+			cli.bump_fee()
+			cli.state = STATE_INIT
+
 		case STATE_BILL:
 			cli.get_bill(&bill)
 		case STATE_BILL_SAVE:
@@ -296,24 +306,32 @@ func (cli *Cli) pay() {
 	for name := range keys {
 		options = append(options, name)
 	}
-	menu := inf.NewSingleSelect(
+	sort.Strings(options)
+	menu := inf.NewMultiSelect(
 		options,
-		singleselect.WithFocusSymbol("->"),
-		singleselect.WithDisableFilter(),
-		singleselect.WithPageSize(5),
-		singleselect.WithKeyBinding(selectKeymap),
+		multiselect.WithChoiceTextStyle(theme.DefaultTheme.ChoiceTextStyle),
+		multiselect.WithFocusSymbol("->"),
+		multiselect.WithPageSize(5),
 	)
 
 	choices, err := menu.Display(
-		"Payment: Select keys to pay(Ctrl-C to cancel)",
+		"Payment: Select keys to pay from, the change goes to the first one(Ctrl-C to cancel)",
 	)
-	if err != nil {
+	if err != nil || len(choices) == 0 {
 		fmt.Println("Payment canceled")
 		return
 	}
 
+	// The payment can spend the outputs of all the selected keys
 	balance := *cli.wallet.GetBalance()
-	fmt.Printf("Key [%s], Balance: %d(Maybe not synchronized)\n", options[choices], balance[options[choices]])
+	names := make([]string, 0, len(choices))
+	total := 0
+	for _, choice := range choices {
+		names = append(names, options[choice])
+		total += balance[options[choice]]
+		fmt.Printf("Key [%s], Balance: %d\n", options[choice], balance[options[choice]])
+	}
+	fmt.Printf("Total Balance: %d(Maybe not synchronized)\n", total)
 
 	amount := inf.NewText(
 		text.WithPrompt("Enter the amount:"),
@@ -407,35 +425,43 @@ func (cli *Cli) pay() {
 		address = pubs[options_[choicepub]]
 	}
 
-	tx, err := (*(cli.server)).ConstructTransaction(
-		context.Background(),
-		&pb.TransactionConstruct{
-			SendAddr: keys[options[choices]],
-			RecvAddr: address,
-			Amount:   uint64(amount_int),
-			Fee:      uint64(fee_int),
-		},
-	)
-
+	recv, err := crypto.FromBytes(address)
 	if err != nil {
 		fmt.Printf("Construct Transaction Error: %v\n", err)
 		return
 	}
 
-	tx_, err := pri.Deserialize(tx.Transaction)
-
+	strategies := []string{
+		"Largest coins first (fewest inputs)",
+		"Exact match (no change if possible)",
+		"Random coins (privacy)",
+	}
+	strategy, err := inf.NewSingleSelect(
+		strategies,
+		singleselect.WithFocusSymbol("->"),
+		singleselect.WithDisableFilter(),
+		singleselect.WithPageSize(5),
+		singleselect.WithKeyBinding(selectKeymap),
+	).Display(
+		"Payment: Select how to pick the coins to spend(Ctrl-C to cancel)",
+	)
 	if err != nil {
-		fmt.Printf("Construct Transaction Error: %v\n", err)
+		fmt.Println("Payment canceled")
 		return
 	}
 
-	tx__, ok := tx_.(*pri.Transaction)
-	if !ok {
-		fmt.Printf("Construct Transaction Error\n")
+	// The transaction is built and signed by the wallet, the
+	// daemon only sees it when it is broadcast
+	payment, err := cli.wallet.ConstructTransaction(
+		names, recv, uint64(amount_int), uint64(fee_int), wallet.CoinSelection(strategy))
+	if err != nil {
+		fmt.Printf("Construct Transaction Error: %v\n", err)
+		return
 	}
+	fmt.Printf("Spending %d coins, fee %d\n", len(payment.Tx.GetTxIns()), payment.Fee)
 
 	val, err := inf.NewConfirmWithSelection(
-		confirm.WithPrompt("Are you sure to sign this transaction and broadcast it?"),
+		confirm.WithPrompt("Are you sure to broadcast this transaction?"),
 	).Display()
 
 	if err != nil {
@@ -443,11 +469,15 @@ func (cli *Cli) pay() {
 	}
 
 	if val {
-		cli.wallet.SignTransaction(tx__, options[choices])
-		tx_bytes, _ := pri.Serialize(tx__)
-		(*cli.server).BroadcastTransaction(context.Background(), &pb.Transaction{
+		tx_bytes, _ := pri.Serialize(payment.Tx)
+		_, err := (*cli.server).BroadcastTransaction(context.Background(), &pb.Transaction{
 			Transaction: tx_bytes,
 		})
+		if err != nil {
+			fmt.Printf("Broadcast Transaction Error: %v\n", err)
+			return
+		}
+		cli.wallet.AddSent(payment)
 
 		fmt.Println("Transaction broadcast, wait some time to see the result")
 	} else {
@@ -456,6 +486,79 @@ func (cli *Cli) pay() {
 	cli.state = STATE_INIT
 }
 
+// The function replaces a payment not mined yet by one paying a higher
+// fee, taken from its change.
+func (cli *Cli) bump_fee() {
+	sent := cli.wallet.GetSent()
+	if len(sent) == 0 {
+		fmt.Println("No payment waiting to be mined")
+		return
+	}
+	options := make([]string, 0, len(sent))
+	for _, tx := range sent {
+		options = append(options, fmt.Sprintf("0x%x, key [%s], fee %d, sent at %s",
+			tx.Hash[:8], tx.Key, tx.Fee, tx.Time.Format(layout)))
+	}
+	menu := inf.NewSingleSelect(
+		options,
+		singleselect.WithFocusSymbol("->"),
+		singleselect.WithDisableFilter(),
+		singleselect.WithPageSize(5),
+		singleselect.WithKeyBinding(selectKeymap),
+	)
+	choice, err := menu.Display(
+		"Bump fee: Select a payment(Ctrl-C to cancel)",
+	)
+	if err != nil {
+		fmt.Println("Bump fee canceled")
+		return
+	}
+	original := sent[choice]
+
+	fee := inf.NewText(
+		text.WithPrompt("Enter the new fee:"),
+		text.WithFocusSymbol("->"),
+		text.WithRequired(),
+		text.WithRequiredMsg("Fee is required(only numbers, invalid one to quit)"),
+		text.WithDefaultValue(strconv.FormatUint(2*original.Fee+1, 10)),
+	)
+	fee_str, err := fee.Display()
+	if err != nil {
+		fmt.Println("Bump fee canceled")
+		return
+	}
+	fee_int, err := strconv.ParseUint(fee_str, 10, 64)
+	if err != nil {
+		fmt.Println("Bump fee canceled")
+		return
+	}
+
+	tx, err := cli.wallet.BumpFee(original.Hash, fee_int)
+	if err != nil {
+		fmt.Printf("Bump Fee Error: %v\n", err)
+		return
+	}
+
+	val, err := inf.NewConfirmWithSelection(
+		confirm.WithPrompt(fmt.Sprintf("Are you sure to pay %d more to replace this payment?", fee_int-original.Fee)),
+	).Display()
+	if err != nil || !val {
+		fmt.Println("Bump fee canceled")
+		return
+	}
+
+	tx_bytes, _ := pri.Serialize(tx.Tx)
+	_, err = (*cli.server).BroadcastTransaction(context.Background(), &pb.Transaction{
+		Transaction: tx_bytes,
+	})
+	if err != nil {
+		fmt.Printf("Broadcast Transaction Error: %v\n", err)
+		return
+	}
+	cli.wallet.ReplaceSent(original.Hash, tx)
+	fmt.Println("Replacement broadcast, wait some time to see the result")
+}
+
 func (cli *Cli) get_bill(bill *dataframe.DataFrame) {
 	keys := cli.wallet.GetSelfAddress()
 	options := make([]string, 0, len(keys))
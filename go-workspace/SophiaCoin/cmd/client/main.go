@@ -4,10 +4,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"os-project/SophiaCoin/cmd/client/cli"
+	"os-project/SophiaCoin/pkg/chaincfg"
+	"os-project/SophiaCoin/pkg/peer"
 	pri "os-project/SophiaCoin/pkg/primitives"
 	pb "os-project/SophiaCoin/pkg/rpc"
 	"os-project/SophiaCoin/pkg/wallet"
@@ -20,12 +25,19 @@ import (
 
 var (
 	// Command line options
-	daemon = flag.String("daemon", "10.1.0.112:51151", "Daemon to connect to")
-	ip     = flag.String("ip", "127.0.0.1", "IP to listen on")
-	port   = flag.String("port", "51152", "Port to listen on")
-	dir    = flag.String("dir", "/osdata/osgroup4/SophiaCoin", "SophiaCoin directory")
+	daemon  = flag.String("daemon", "", "Daemon to connect to, 10.1.0.112 at the default port of the network if empty")
+	ip      = flag.String("ip", "127.0.0.1", "IP to listen on")
+	port    = flag.String("port", "51152", "Port to listen on")
+	dir     = flag.String("dir", "", "SophiaCoin directory, ~/.sophiacoin if empty")
+	network = flag.String("network", "mainnet", "Network of the daemon: mainnet, testnet or regtest")
 
 	server pb.BroadcastServiceClient
+
+	// Fetching the records of a block is given up after FETCH_ATTEMPTS
+	// attempts, each waiting longer before the next one
+	FETCH_ATTEMPTS    = 5
+	FETCH_RETRY_DELAY = time.Second
+	FETCH_TIMEOUT     = 30 * time.Second
 )
 
 type Client struct {
@@ -33,6 +45,7 @@ type Client struct {
 
 	wallet   *wallet.Wallet
 	taskPool *taskPool.Pool
+	syncLock sync.Mutex
 }
 
 func newClient(dir string) *Client {
@@ -51,152 +64,185 @@ func (c *Client) BroadcastTransaction(ctx context.Context, tx *pb.Transaction) (
 	return &empty.Empty{}, nil
 }
 
-func (c *Client) BroadcastBlock(stream pb.BroadcastService_BroadcastBlockServer) error {
-	msg, err := stream.Recv()
-	if err != nil {
-		return err
-	}
-
-	block, err := pri.Deserialize(msg.Block)
-	if err != nil {
-		return err
-	}
-
-	latestBlock, ok := block.(*pri.Block)
-	if !ok {
-		return err
+func (c *Client) Inventory(ctx context.Context, inv *pb.Inv) (*empty.Empty, error) {
+	for _, item := range inv.Items {
+		if item.Type == pb.InvType_INV_BLOCK {
+			// Not in the task pool, which syncHeaders adds tasks to
+			go func() {
+				if err := c.syncHeaders(); err != nil {
+					log.Printf("Failed to sync headers: %v\n", err)
+				}
+			}()
+			break
+		}
 	}
+	return &empty.Empty{}, nil
+}
 
-	// log.Printf("Received block %v\n", latestBlock.GetHeader())
+// The function downloads the headers following the last one the wallet
+// has in common with the daemon, and fetches the records of the new blocks.
+func (c *Client) syncHeaders() error {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
 
 	height, _ := c.wallet.GetLatestInfo()
-	if height >= msg.BlockHeight {
-		return nil
-	}
-
-	headers := []*pri.BlockHeader{latestBlock.GetHeader()}
-	for i := msg.BlockHeight - 1; ; i-- {
-		if headers[len(headers)-1].VerifyPreviousHash(c.wallet.GetHeaderHash(i)) {
-			break
+	heights := map[pri.HashResult]uint32{}
+	request := &pb.HeadersRequest{}
+	step := 1
+	for h := int(height); h >= 0; h -= step {
+		hash := c.wallet.GetHeaderHash(uint32(h))
+		heights[hash] = uint32(h)
+		request.Locator = append(request.Locator, hash[:])
+		if len(request.Locator) >= 10 {
+			step *= 2
 		}
-		if i == 0 {
-			return nil
+		if h > 0 && h < step {
+			step = h // always end with the genesis block
 		}
-		stream.Send(&pb.BlockRequest{
-			BlockHeight: i,
-			HeaderOnly:  true,
-		})
-		msg, err := stream.Recv()
+	}
+
+	for {
+		response, err := server.GetHeaders(context.Background(), request)
 		if err != nil {
 			return err
 		}
-		blockHeader, err := pri.Deserialize(msg.Block)
-		if err != nil {
-			return err
+		if len(response.Headers) == 0 {
+			return nil
+		}
+
+		headers := []*pri.BlockHeader{}
+		for _, headerBytes := range response.Headers {
+			header, err := pri.Deserialize(headerBytes)
+			if err != nil {
+				return err
+			}
+			header_, ok := header.(*pri.BlockHeader)
+			if !ok {
+				return fmt.Errorf("invalid block header")
+			}
+			headers = append(headers, header_)
 		}
 
-		header, ok := blockHeader.(*pri.BlockHeader)
+		from, ok := heights[headers[0].GetPrevHash()]
 		if !ok {
+			return fmt.Errorf("headers do not build on a known block")
+		}
+		from++
+		err = c.wallet.UpdateHeaders(from, headers...)
+		if err != nil {
 			return err
 		}
+		to := from + uint32(len(headers)) - 1
+		c.fetchRecords(from, to)
 
-		headers = append(headers, header)
-	}
-
-	// reverse headers
-	for i := 0; i < len(headers)/2; i++ {
-		headers[i], headers[len(headers)-i-1] = headers[len(headers)-i-1], headers[i]
+		last := pri.Hash(headers[len(headers)-1])
+		heights[last] = to
+		request = &pb.HeadersRequest{Locator: [][]byte{last[:]}}
 	}
+}
 
-	err = c.wallet.UpdateHeaders(msg.BlockHeight+1-uint32(len(headers)), headers...)
-	if err != nil {
-		return nil
-	}
-
-	height, _ = c.wallet.GetLatestInfo()
-
+// The function fetches the records of the wallet's keys in
+// the blocks between the given heights.
+func (c *Client) fetchRecords(from uint32, to uint32) {
 	keys := c.wallet.GetSelfAddress()
-	for i := msg.BlockHeight + 1 - uint32(len(headers)); i <= height; i++ {
+	for i := from; i <= to; i++ {
 		for name, key := range keys {
-			if err != nil {
-				panic(err)
-			}
-
 			c.taskPool.AddTask(&taskPool.Task{
 				Handler: func(params ...interface{}) {
 					i := params[0].(uint32)
 					name := params[1].(string)
 					key := params[2].([]byte)
-					var err error = fmt.Errorf("dummy")
-					var stream pb.BroadcastService_RequestTransactionsByPublicKeyClient
-					blockHash := c.wallet.GetHeaderHash(i)
-					// log.Printf("Block %d: Fetching records...\n", i)
-					for err != nil {
-						stream, err = server.RequestTransactionsByPublicKey(
-							context.Background(),
-							&pb.TransactionRequestByPublicKey{
-								BlockHeight: i,
-								PublicKey:   key,
-								BlockHash:   blockHash[:],
-							},
-						)
+					records, err := c.fetchBlockRecords(i, name, key)
+					for attempt := 1; err != nil && attempt < FETCH_ATTEMPTS; attempt++ {
+						time.Sleep(time.Duration(attempt) * FETCH_RETRY_DELAY)
+						records, err = c.fetchBlockRecords(i, name, key)
 					}
-
-					records := []*wallet.TxRecord{}
-
-					var res *pb.TransactionInfo
-					for res, err = stream.Recv(); err == nil; res, err = stream.Recv() {
-						tx, err := pri.Deserialize(res.Transaction)
-						if err != nil {
-							continue
-						}
-						tx_, ok := tx.(*pri.Transaction)
-						if !ok {
-							continue
-						}
-
-						res_block_hash := pri.HashResult(res.BlockHash)
-						record := wallet.NewRecord(
-							int(res.BlockHeight),
-							res_block_hash,
-							pri.Hash(tx_),
-							int(res.TransactionIndex),
-							res.IsTxIn,
-							int(res.InOutIdx),
-							int(res.Amount),
-							name,
-							res.MerkleProof,
-						)
-
-						records = append(records, &record)
+					if err != nil {
+						log.Printf("Block %d: Fetching records of %s failed: %v\n", i, name, err)
+						return
 					}
-
-					// if err != nil {
-					// 	log.Printf("Block %d: Fetching records failed: %v\n", i, err)
-					// }
-
-					// log.Printf("Block %d: Fetching %d records...\n", i, len(records))
-
 					c.wallet.AddTxRecords(records...)
 				},
 				Params: []interface{}{i, name, key},
 			})
 		}
 	}
+}
 
-	return nil
+// The function fetches the records of the key in the block at the
+// height. No record is returned unless all of them were received.
+func (c *Client) fetchBlockRecords(height uint32, name string, key []byte) ([]*wallet.TxRecord, error) {
+	blockHash := c.wallet.GetHeaderHash(height)
+	ctx, cancel := context.WithTimeout(context.Background(), FETCH_TIMEOUT)
+	defer cancel()
+	stream, err := server.RequestTransactionsByPublicKey(ctx, &pb.TransactionRequestByPublicKey{
+		BlockHeight: height,
+		PublicKey:   key,
+		BlockHash:   blockHash[:],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*wallet.TxRecord{}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tx, err := pri.Deserialize(res.Transaction)
+		if err != nil {
+			return nil, err
+		}
+		tx_, ok := tx.(*pri.Transaction)
+		if !ok {
+			return nil, fmt.Errorf("invalid transaction")
+		}
+
+		record := wallet.NewRecord(
+			int(res.BlockHeight),
+			pri.HashResult(res.BlockHash),
+			tx_,
+			int(res.TransactionIndex),
+			res.IsTxIn,
+			int(res.InOutIdx),
+			int(res.Amount),
+			name,
+			res.MerkleProof,
+		)
+		records = append(records, &record)
+	}
 }
 
-func (c *Client) ConstructTransaction(ctx context.Context, request *pb.TransactionConstruct) (*pb.Transaction, error) {
-	return nil, nil
+func (c *Client) Handshake(ctx context.Context, version *pb.Version) (*pb.Version, error) {
+	if err := peer.CheckVersion(version); err != nil {
+		log.Printf("Rejected handshake: %v\n", err)
+		return nil, err
+	}
+	log.Printf("Received handshake from %s:%s\n", version.Addr.Ip, version.Addr.Port)
+	return c.version(), nil
 }
 
-func (c *Client) Handshake(ctx context.Context, addr *pb.Address) (*pb.Address, error) {
-	log.Printf("Received handshake from %s:%s\n", addr.Ip, addr.Port)
-	return &pb.Address{
-		Ip:   *ip,
-		Port: *port,
-	}, nil
+// The version of the wallet, as sent in handshakes. A wallet serves
+// nothing, it only follows the headers of the daemon.
+func (c *Client) version() *pb.Version {
+	height, tip := c.wallet.GetLatestInfo()
+	return &pb.Version{
+		ProtocolVersion: peer.PROTOCOL_VERSION,
+		Network:         peer.NETWORK_MAGIC,
+		NodeType:        pb.NodeType_WALLET,
+		Addr:            &pb.Address{Ip: *ip, Port: *port},
+		BestHeight:      height,
+		TipHash:         tip[:],
+	}
+}
+
+func (c *Client) Ping(ctx context.Context, ping *pb.PingMessage) (*pb.PingMessage, error) {
+	height, _ := c.wallet.GetLatestInfo()
+	return &pb.PingMessage{Nonce: ping.Nonce, BestHeight: height}, nil
 }
 
 func (c *Client) RequestTransactionsByPublicKey(
@@ -205,7 +251,7 @@ func (c *Client) RequestTransactionsByPublicKey(
 	return nil
 }
 
-func connect(addr string) error {
+func (c *Client) connect(addr string) error {
 	log.Printf("Connecting to %s\n", addr)
 	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -213,16 +259,32 @@ func connect(addr string) error {
 		return err
 	}
 	server = pb.NewBroadcastServiceClient(conn)
-	_, err = server.Handshake(context.Background(), &pb.Address{
-		Ip:   *ip,
-		Port: *port,
-	})
-	return err
+	remote, err := server.Handshake(context.Background(), c.version())
+	if err != nil {
+		return err
+	}
+	if err := peer.CheckVersion(remote); err != nil {
+		return err
+	}
+	if remote.NodeType != pb.NodeType_FULL_NODE {
+		return fmt.Errorf("%s is not a full node", addr)
+	}
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
+	params, err := chaincfg.Get(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	params.Apply()
+	if *daemon == "" {
+		*daemon = net.JoinHostPort("10.1.0.112", params.DefaultPort)
+	}
+	*dir = params.DataDir(*dir)
+
 	addr := net.JoinHostPort(*ip, *port)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -234,37 +296,15 @@ func main() {
 	pb.RegisterBroadcastServiceServer(grpcServer, client)
 	go grpcServer.Serve(lis)
 
-	err = connect(*daemon)
+	err = client.connect(*daemon)
 
 	if err != nil {
 		log.Printf("Failed to connect to daemon, Exiting...")
 		return
 	}
-
-	// recv_addr, _ := hex.DecodeString("3059301306072a8648ce3d020106082a8648ce3d03010703420004993be5b8329fdbf4a23a43bc7406a0de33fd8708f2676e9ec04ef97e78a34db4c6a5a82102897508ddf687ad8eaf3bd298616971d18c4c5b9a2f4ebe821439b3")
-	// res, err := server.ConstructTransaction(context.Background(), &pb.TransactionConstruct{
-	// 	SendAddr: client.wallet.GetAddress()["miner"],
-	// 	RecvAddr: recv_addr,
-	// 	Amount:   4053,
-	// 	Fee:      43,
-	// })
-
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	// tx, _ := pri.Deserialize(res.Transaction)
-	// tx_ := tx.(*pri.Transaction)
-	// err = client.wallet.SignTransaction(tx_, "miner")
-	// if err != nil {
-	// 	panic(err)
-	// }
-	// tx_bytes, _ := pri.Serialize(tx_)
-	// server.BroadcastTransaction(context.Background(), &pb.Transaction{
-	// 	Transaction: tx_bytes,
-	// })
-
-	// time.Sleep(time.Second * 100)
+	if err := client.syncHeaders(); err != nil {
+		log.Printf("Failed to sync headers: %v\n", err)
+	}
 
 	// blockHash := client.wallet.GetHeaderHash(6)
 	// server.RequestTransactionsByPublicKey(context.Background(), &pb.TransactionRequestByPublicKey{
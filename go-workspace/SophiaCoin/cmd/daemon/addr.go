@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"os-project/SophiaCoin/pkg/peer"
+	"time"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+const (
+	maxAddrsPerMessage = 100
+	addrInterval       = 10 * time.Minute // between two address exchanges
+)
+
+// The function adds the addresses shared by a peer to the address book.
+func learnAddrs(addrs *pb.Addrs) {
+	self := net.JoinHostPort(*ip, *port)
+	learned := []string{}
+	for _, a := range addrs.Addrs {
+		if a.Ip == "" || a.Port == "" {
+			continue
+		}
+		addr := net.JoinHostPort(a.Ip, a.Port)
+		if addr != self && !peerManager.IsBanned(addr) {
+			learned = append(learned, addr)
+		}
+	}
+	if err := addrBook.Add(learned...); err != nil {
+		log.Printf("Failed to save the address book: %v\n", err)
+	}
+}
+
+// The function returns the addresses to share with a peer.
+func goodAddrs() *pb.Addrs {
+	result := &pb.Addrs{}
+	for _, addr := range addrBook.GoodAddrs(maxAddrsPerMessage) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		result.Addrs = append(result.Addrs, &pb.Address{Ip: host, Port: port})
+	}
+	return result
+}
+
+func exchangeAddrs(p *peer.Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), peer.REQUEST_TIMEOUT)
+	defer cancel()
+	reply, err := p.Client.ExchangeAddrs(ctx, goodAddrs())
+	if err != nil {
+		log.Printf("Failed to exchange addresses with %s: %v\n", p.Addr, err)
+		return
+	}
+	if len(reply.Addrs) > maxAddrsPerMessage {
+		return
+	}
+	learnAddrs(reply)
+}
+
+// The function exchanges addresses with a random peer every addrInterval,
+// so that the addresses spread over the network.
+func gossipAddrs() {
+	for range time.Tick(addrInterval) {
+		peers := peerManager.Peers()
+		if len(peers) > 0 {
+			exchangeAddrs(peers[rand.Intn(len(peers))])
+		}
+	}
+}
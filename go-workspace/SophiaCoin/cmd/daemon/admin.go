@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"runtime"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+
+	"github.com/golang/protobuf/ptypes/empty"
+)
+
+// The admin service is only served to the local host.
+type Admin struct {
+	pb.UnimplementedAdminServiceServer
+}
+
+func checkLocal(ctx context.Context) error {
+	host, _, err := net.SplitHostPort(remoteAddr(ctx))
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin requests are only accepted from the local host")
+	}
+	return nil
+}
+
+func (a *Admin) ListBans(ctx context.Context, _ *empty.Empty) (*pb.Bans, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	bans := &pb.Bans{}
+	for _, info := range banList.List() {
+		bans.Bans = append(bans.Bans, &pb.Ban{
+			Host:   info.Host,
+			Until:  info.Until.Unix(),
+			Reason: info.Reason,
+		})
+	}
+	return bans, nil
+}
+
+func (a *Admin) ClearBans(ctx context.Context, request *pb.ClearBansRequest) (*empty.Empty, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	if err := banList.Clear(request.Host); err != nil {
+		return nil, err
+	}
+	return &empty.Empty{}, nil
+}
+
+// The function mines blocks right away, on a network where
+// blocks are generated on request, and relays the new tip.
+func (a *Admin) Generate(ctx context.Context, request *pb.GenerateRequest) (*pb.BlockHashes, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	if !params.GenerateOnDemand {
+		return nil, fmt.Errorf("blocks are not generated on request on %s", params.Name)
+	}
+	hashes := &pb.BlockHashes{}
+	for i := uint32(0); i < request.Blocks; i++ {
+		block, err := pool.Generate()
+		if err != nil {
+			return nil, err
+		}
+		hash := pri.Hash(block)
+		hashes.Hashes = append(hashes.Hashes, hash[:])
+	}
+	if len(hashes.Hashes) > 0 {
+		relayInventory(blockInventory(pri.HashResult(hashes.Hashes[len(hashes.Hashes)-1])))
+	}
+	return hashes, nil
+}
+
+func miningInfo() *pb.MiningInfo {
+	running, workers := blockMiner.Running()
+	template := pool.GetBlockTemplate()
+	return &pb.MiningInfo{
+		Running:    running,
+		Workers:    uint32(workers),
+		HashRate:   blockMiner.HashRate(),
+		Height:     template.Height,
+		Difficulty: template.Difficulty,
+	}
+}
+
+func (a *Admin) StartMining(ctx context.Context, request *pb.MiningRequest) (*pb.MiningInfo, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	workers := int(request.Workers)
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	blockMiner.Start(workers)
+	return miningInfo(), nil
+}
+
+func (a *Admin) StopMining(ctx context.Context, _ *empty.Empty) (*pb.MiningInfo, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	blockMiner.Stop()
+	return miningInfo(), nil
+}
+
+func (a *Admin) GetMiningInfo(ctx context.Context, _ *empty.Empty) (*pb.MiningInfo, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	return miningInfo(), nil
+}
+
+func payoutKeysMessage() *pb.PayoutKeys {
+	message := &pb.PayoutKeys{}
+	for _, key := range pool.GetPayoutKeys() {
+		message.Keys = append(message.Keys, key.ToBytes())
+	}
+	return message
+}
+
+// The function replaces the payout keys of the daemon. With -payoutfile
+// they are written to the file, otherwise they are not saved and the
+// flags apply again after a restart.
+func (a *Admin) SetPayoutKeys(ctx context.Context, request *pb.PayoutKeys) (*pb.PayoutKeys, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	keys := []*crypto.PublicKey{}
+	for _, data := range request.Keys {
+		key, err := crypto.FromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payout key %x: %v", data, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := pool.SetPayoutKeys(keys...); err != nil {
+		return nil, err
+	}
+	if *payoutFile != "" {
+		if err := savePayoutFile(*payoutFile, keys); err != nil {
+			return nil, fmt.Errorf("payout keys set, but not saved to %s: %v", *payoutFile, err)
+		}
+	}
+	return payoutKeysMessage(), nil
+}
+
+func (a *Admin) GetPayoutKeys(ctx context.Context, _ *empty.Empty) (*pb.PayoutKeys, error) {
+	if err := checkLocal(ctx); err != nil {
+		return nil, err
+	}
+	return payoutKeysMessage(), nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os-project/SophiaCoin/pkg/mempool"
+	"os-project/SophiaCoin/pkg/peer"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"sync"
+	"time"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+const requestTimeout = 30 * time.Second // after which an item is requested again
+
+var (
+	requested     = map[pri.HashResult]time.Time{} // hash -> when it was requested
+	requestedLock sync.Mutex
+)
+
+// The function marks the hash as requested, and returns false
+// if it has already been requested from another peer recently.
+func markRequested(hash pri.HashResult) bool {
+	requestedLock.Lock()
+	defer requestedLock.Unlock()
+
+	now := time.Now()
+	for other, at := range requested {
+		if now.Sub(at) > requestTimeout {
+			delete(requested, other)
+		}
+	}
+	if _, ok := requested[hash]; ok {
+		return false
+	}
+	requested[hash] = now
+	return true
+}
+
+func unmarkRequested(hash pri.HashResult) {
+	requestedLock.Lock()
+	defer requestedLock.Unlock()
+
+	delete(requested, hash)
+}
+
+func hasInventory(pool *mempool.Mempool, item *pb.InvItem) bool {
+	hash := pri.HashResult(item.Hash)
+	switch item.Type {
+	case pb.InvType_INV_TX:
+		return pool.HasTransaction(hash)
+	case pb.InvType_INV_BLOCK:
+		return pool.HasBlock(hash)
+	}
+	return true
+}
+
+// The function announces the items to every peer not known to have them.
+func relayInventory(items ...*pb.InvItem) {
+	for _, p := range peerManager.Peers() {
+		inv := &pb.Inv{From: selfAddress(pool)}
+		for _, item := range items {
+			hash := pri.HashResult(item.Hash)
+			if p.Known.Has(hash) {
+				continue
+			}
+			p.Known.Add(hash)
+			inv.Items = append(inv.Items, item)
+		}
+		if len(inv.Items) == 0 {
+			continue
+		}
+
+		go func(p *peer.Peer) {
+			ctx, cancel := context.WithTimeout(context.Background(), peer.REQUEST_TIMEOUT)
+			defer cancel()
+			_, err := p.Client.Inventory(ctx, inv)
+			if err != nil {
+				log.Printf("Failed to send inventory to %s: %v\n", p.Addr, err)
+			}
+		}(p)
+	}
+}
+
+func txInventory(hash pri.HashResult) *pb.InvItem {
+	return &pb.InvItem{Type: pb.InvType_INV_TX, Hash: hash[:]}
+}
+
+func blockInventory(hash pri.HashResult) *pb.InvItem {
+	return &pb.InvItem{Type: pb.InvType_INV_BLOCK, Hash: hash[:]}
+}
+
+// The function returns the connected peer at the address an announcement
+// gives as its sender, or nil if there is none or the announcement comes
+// from another host.
+func announcer(ctx context.Context, from *pb.Address) *peer.Peer {
+	if !sentFrom(ctx, from) {
+		return nil
+	}
+	return peerManager.Get(net.JoinHostPort(from.Ip, from.Port))
+}
+
+// The function tells whether the request comes from the IP of the
+// address the sender claims as its own.
+func sentFrom(ctx context.Context, from *pb.Address) bool {
+	host, _, err := net.SplitHostPort(remoteAddr(ctx))
+	if err != nil {
+		return false
+	}
+	ip, fromIp := net.ParseIP(host), net.ParseIP(from.Ip)
+	return ip != nil && fromIp != nil && ip.Equal(fromIp)
+}
+
+// The function requests the items from the peer that announced them, adds
+// them to the pool, and announces the accepted ones to the other peers.
+func (n *Node) fetchInventory(p *peer.Peer, inv *pb.Inv) {
+	defer func() {
+		for _, item := range inv.Items {
+			unmarkRequested(pri.HashResult(item.Hash))
+		}
+	}()
+
+	addr := p.Addr
+	ctx, cancel := context.WithTimeout(context.Background(), peer.REQUEST_TIMEOUT)
+	defer cancel()
+	stream, err := p.Client.GetData(ctx, inv)
+	if err != nil {
+		log.Printf("Failed to get data from %s: %v\n", addr, err)
+		return
+	}
+
+	_, tip := n.pool.GetLatestInfo()
+	defer n.relayNewTip(pri.Hash(tip))
+
+	for {
+		data, err := stream.Recv()
+		if err != nil {
+			return
+		}
+		object, err := pri.Deserialize(data.Data)
+		if err != nil {
+			log.Printf("Invalid data from %s: %v\n", addr, err)
+			peerManager.Misbehaving(addr, peer.SCORE_UNDECODABLE, "undecodable data")
+			return
+		}
+
+		switch object := object.(type) {
+		case *pri.Transaction:
+			hash := pri.Hash(object)
+			if err := n.pool.AddTransaction(object); err != nil {
+				log.Printf("Failed to add transaction %x: %v\n", hash, err)
+				continue
+			}
+			log.Printf("Received transaction %x from %s\n", hash, addr)
+			relayInventory(txInventory(hash))
+		case *pri.Block:
+			hash := pri.Hash(object)
+			status, err := n.pool.ProcessBlock(object)
+			if err != nil {
+				log.Printf("Failed to process block %x: %v\n", hash, err)
+				checkBlockError(addr, err)
+				continue
+			}
+			log.Printf("Received block %x from %s\n", hash, addr)
+			if status == mempool.BlockOrphan {
+				// Not in the task pool, the download can take long
+				startSync(p)
+			}
+		default:
+			log.Printf("Unexpected data from %s\n", addr)
+			peerManager.Misbehaving(addr, peer.SCORE_UNDECODABLE, "unexpected data")
+			return
+		}
+	}
+}
@@ -5,18 +5,26 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
+	"os"
+	"os-project/SophiaCoin/pkg/chaincfg"
 	"os-project/SophiaCoin/pkg/crypto"
 	"os-project/SophiaCoin/pkg/mempool"
+	"os-project/SophiaCoin/pkg/miner"
+	"os-project/SophiaCoin/pkg/peer"
 	pri "os-project/SophiaCoin/pkg/primitives"
-	"sync"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
 
 	pb "os-project/SophiaCoin/pkg/rpc"
 	taskpool "os-project/part12/pool"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 // stringSlice is a custom flag type, implements flag.Value interface
@@ -32,14 +40,32 @@ func (s *stringSlice) Set(value string) error {
 
 var (
 	// Command line options
-	peers      stringSlice
-	ip         = flag.String("ip", "10.1.0.112", "IP to listen on")
-	port       = flag.String("port", "51151", "Port to listen on")
-	dir        = flag.String("dir", "/osdata/osgroup4/SophiaCoin", "SophiaCoin directory")
-	difficulty = flag.Uint("difficulty", 4, "Difficulty of mining")
-
-	// grpc
-	clients = make(map[string]pb.BroadcastServiceClient)
+	peers       stringSlice
+	payouts     stringSlice
+	miningAllow stringSlice
+	ip          = flag.String("ip", "10.1.0.112", "IP to listen on")
+	port        = flag.String("port", "", "Port to listen on, the default port of the network if empty")
+	dir         = flag.String("dir", "", "SophiaCoin directory, ~/.sophiacoin if empty")
+	network     = flag.String("network", "mainnet", "Network to run on: mainnet, testnet or regtest")
+	reindex     = flag.Bool("reindex", false, "Rebuild the chain state from the block store")
+	mine        = flag.Bool("mine", true, "Mine on startup, except on networks where blocks are generated on request")
+	workers     = flag.Int("miners", runtime.NumCPU(), "Number of mining goroutines")
+
+	rbf        = flag.Bool("rbf", true, "Let pending transactions signaling it be replaced by ones paying a higher fee")
+	payoutFile = flag.String("payoutfile", "", "File of payout keys in hex, one per line")
+
+	// The pending transactions are saved on shutdown, and every
+	// mempoolSaveInterval in case the daemon is killed
+	mempoolSaveInterval = 5 * time.Minute
+
+	maxInbound  = flag.Int("maxinbound", 16, "Maximum number of peers connecting to us")
+	maxOutbound = flag.Int("maxoutbound", 8, "Maximum number of peers we connect to")
+
+	params      *chaincfg.Params
+	peerManager *peer.Manager
+	blockMiner  *miner.Miner
+	addrBook    *peer.AddrBook
+	banList     *peer.BanList
 
 	pool *mempool.Mempool
 )
@@ -53,35 +79,33 @@ type Node struct {
 
 func (n *Node) BroadcastTransaction(ctx context.Context, tx *pb.Transaction) (*empty.Empty, error) {
 	the_tx, err := pri.Deserialize(tx.Transaction)
-	if err != nil {
-		return &empty.Empty{}, err
-	}
 	tx_, ok := the_tx.(*pri.Transaction)
-	if !ok {
-		return &empty.Empty{}, err
+	if !ok || err != nil {
+		misbehaving(remoteAddr(ctx), peer.SCORE_UNDECODABLE, "undecodable transaction")
+		return &empty.Empty{}, fmt.Errorf("invalid transaction")
 	}
 
-	log.Printf("Received transaction %x\n", pri.Hash(tx_))
+	hash := pri.Hash(tx_)
+	log.Printf("Received transaction %x\n", hash)
+	if n.pool.HasTransaction(hash) {
+		return &empty.Empty{}, nil
+	}
 
 	// Verify transaction
 	err = n.pool.AddTransaction(tx_)
 	if err != nil {
-		log.Printf("Failed to add transaction %x: %v\n", pri.Hash(tx_), err)
-		log.Printf("Don't Panic: Maybe the transaction already exists.\n")
+		log.Printf("Failed to add transaction %x: %v\n", hash, err)
 		return &empty.Empty{}, err
 	}
 
-	n.taskPool.AddTask(
-		&taskpool.Task{
-			Handler: func(params ...interface{}) {
-				broadcastTransaction(tx)
-			},
-		},
-	)
+	relayInventory(txInventory(hash))
 	return &empty.Empty{}, nil
 }
 
+// Blocks are relayed with Inventory and GetData, this is kept
+// for the nodes that still push full blocks.
 func (n *Node) BroadcastBlock(stream pb.BroadcastService_BroadcastBlockServer) error {
+	addr := remoteAddr(stream.Context())
 	latestBlock, err := stream.Recv()
 	if err != nil {
 		log.Println(err)
@@ -91,37 +115,40 @@ func (n *Node) BroadcastBlock(stream pb.BroadcastService_BroadcastBlockServer) e
 	block, err := pri.Deserialize(latestBlock.Block)
 	latestBlock_, ok := block.(*pri.Block)
 	if !ok || err != nil || latestBlock.HeaderOnly {
+		misbehaving(addr, peer.SCORE_UNDECODABLE, "undecodable block")
 		return fmt.Errorf("invalid block")
 	}
 
 	log.Printf("Received block %d\n", latestBlock.BlockHeight)
 
-	height, _ := n.pool.GetLatestInfo()
-	if latestBlock.BlockHeight == height+1 {
-		err = n.pool.AppendBlock(latestBlock_)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
+	height, tip := n.pool.GetLatestInfo()
+	defer n.relayNewTip(pri.Hash(tip))
 
-		n.taskPool.AddTask(
-			&taskpool.Task{
-				Handler: func(params ...interface{}) {
-					broadcastBlock(latestBlock.BlockHeight, latestBlock_, n.pool)
-				},
-			},
-		)
+	status, err := n.pool.ProcessBlock(latestBlock_)
+	if err != nil {
+		log.Println(err)
+		checkBlockError(addr, err)
+		return err
+	}
+	if status != mempool.BlockOrphan {
+		return nil
+	}
 
+	// The block is kept as an orphan until its parent arrives. If the peer
+	// announces more work, request the blocks its chain is made of. The
+	// announced work is only a hint, the block tree checks the real one.
+	peerWork := new(big.Int).SetBytes(latestBlock.TotalWork)
+	if peerWork.Cmp(n.pool.GetTotalWork()) <= 0 {
 		return nil
-	} else if latestBlock.BlockHeight <= height {
-		return fmt.Errorf("block height %d is lower than current height %d", latestBlock.BlockHeight, height)
 	}
 
-	// The peer has a much higher block height, request the newest blocks
 	// First find the common ancestor
 	// Use binary backoff to find the common ancestor
 
 	var backoff, curHeight uint32 = 1, height + 1
+	if latestBlock.BlockHeight < height {
+		curHeight = latestBlock.BlockHeight + 1
+	}
 	var found bool = false
 	for backoff > 0 {
 		checkHeight := curHeight - backoff
@@ -143,12 +170,9 @@ func (n *Node) BroadcastBlock(stream pb.BroadcastService_BroadcastBlockServer) e
 		}
 
 		block, err := pri.Deserialize(response.Block)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
 		header, ok := block.(*pri.BlockHeader)
-		if !ok {
+		if !ok || err != nil {
+			misbehaving(addr, peer.SCORE_UNDECODABLE, "undecodable block header")
 			return fmt.Errorf("invalid block header")
 		}
 
@@ -171,8 +195,7 @@ func (n *Node) BroadcastBlock(stream pb.BroadcastService_BroadcastBlockServer) e
 		}
 	}
 
-	blocks := []*pri.Block{}
-	for i := curHeight; i <= latestBlock.BlockHeight; i++ {
+	for i := curHeight; i < latestBlock.BlockHeight; i++ {
 		log.Printf("Requesting block %d\n", i)
 		err = stream.Send(&pb.BlockRequest{
 			BlockHeight: i,
@@ -191,67 +214,203 @@ func (n *Node) BroadcastBlock(stream pb.BroadcastService_BroadcastBlockServer) e
 		}
 
 		block, err := pri.Deserialize(response.Block)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
 		the_block, ok := block.(*pri.Block)
-		if !ok {
+		if !ok || err != nil {
+			misbehaving(addr, peer.SCORE_UNDECODABLE, "undecodable block")
 			return fmt.Errorf("invalid block")
 		}
 
-		blocks = append(blocks, the_block)
+		if _, err := n.pool.ProcessBlock(the_block); err != nil {
+			log.Println(err)
+			checkBlockError(addr, err)
+			return err
+		}
+	}
+
+	// In case the orphan has been evicted meanwhile
+	_, err = n.pool.ProcessBlock(latestBlock_)
+	return err
+}
+
+// The function announces the tip of the chain if it is not
+// the old one, i.e. a block has extended the chain or a
+// side branch has taken over.
+func (n *Node) relayNewTip(old pri.HashResult) {
+	_, tip := n.pool.GetLatestInfo()
+	if pri.Hash(tip) == old {
+		return
 	}
+	relayInventory(blockInventory(pri.Hash(tip)))
+}
 
-	err = n.pool.SwitchChain(blocks, curHeight)
-	if err == nil {
-		height, last_block := n.pool.GetLatestInfo()
+func (n *Node) Handshake(ctx context.Context, version *pb.Version) (*pb.Version, error) {
+	if err := peer.CheckVersion(version); err != nil {
+		log.Printf("Rejected handshake: %v\n", err)
+		return nil, err
+	}
+	addr := version.Addr
+	log.Printf("Received handshake from %s:%s (%v, version %d), height %d, work %v\n",
+		addr.Ip, addr.Port, version.NodeType, version.ProtocolVersion,
+		version.BestHeight, new(big.Int).SetBytes(version.TotalWork))
+
+	// Connect back to the peer, if there is room for it. An address on
+	// another host than the sender's is not dialed, whoever gave it.
+	if !sentFrom(ctx, addr) {
+		log.Printf("Not connecting back to %s:%s, announced by %s\n", addr.Ip, addr.Port, remoteAddr(ctx))
+		return selfVersion(n.pool), nil
+	}
+	remote := net.JoinHostPort(addr.Ip, addr.Port)
+	if peerManager.Get(remote) == nil {
+		if !peerManager.HasSlot(true) {
+			return nil, fmt.Errorf("too many inbound peers")
+		}
 		n.taskPool.AddTask(
 			&taskpool.Task{
 				Handler: func(params ...interface{}) {
-					broadcastBlock(height, last_block, n.pool)
+					if _, err := peerManager.Connect(remote, true); err != nil {
+						log.Println(err)
+					}
 				},
 			},
 		)
 	}
-	return err
+	return selfVersion(n.pool), nil
 }
 
-func (n *Node) Handshake(ctx context.Context, addr *pb.Address) (*pb.Address, error) {
-	log.Printf("Received handshake from %s:%s\n", addr.Ip, addr.Port)
-	n.taskPool.AddTask(
-		&taskpool.Task{
-			Handler: func(params ...interface{}) {
-				connect(net.JoinHostPort(addr.Ip, addr.Port))
-			},
-		},
-	)
-	return &pb.Address{
-		Ip:   *ip,
-		Port: *port,
-	}, nil
+func (n *Node) ExchangeAddrs(ctx context.Context, addrs *pb.Addrs) (*pb.Addrs, error) {
+	if len(addrs.Addrs) > maxAddrsPerMessage {
+		misbehaving(remoteAddr(ctx), peer.SCORE_FLOOD, "too many addresses")
+		return nil, fmt.Errorf("too many addresses")
+	}
+	learnAddrs(addrs)
+	return goodAddrs(), nil
 }
 
-func (n *Node) ConstructTransaction(ctx context.Context, tc *pb.TransactionConstruct) (*pb.Transaction, error) {
-	sendPubkey, err := crypto.FromBytes(tc.SendAddr)
-	if err != nil {
-		return nil, err
+func (n *Node) Ping(ctx context.Context, ping *pb.PingMessage) (*pb.PingMessage, error) {
+	height, _ := n.pool.GetLatestInfo()
+	return &pb.PingMessage{Nonce: ping.Nonce, BestHeight: height}, nil
+}
+
+func (n *Node) GetHeaders(ctx context.Context, request *pb.HeadersRequest) (*pb.Headers, error) {
+	locator := make([]pri.HashResult, 0, len(request.Locator))
+	for _, hash := range request.Locator {
+		if len(hash) != len(pri.HashResult{}) {
+			misbehaving(remoteAddr(ctx), peer.SCORE_UNDECODABLE, "invalid locator")
+			return nil, fmt.Errorf("invalid locator")
+		}
+		locator = append(locator, pri.HashResult(hash))
 	}
+	var stop pri.HashResult
+	copy(stop[:], request.StopHash)
 
-	receivePubkey, err := crypto.FromBytes(tc.RecvAddr)
-	if err != nil {
-		return nil, err
+	headers := &pb.Headers{}
+	for _, header := range n.pool.FindHeaders(locator, stop, maxHeaders) {
+		headerBytes, err := pri.Serialize(header)
+		if err != nil {
+			return nil, err
+		}
+		headers.Headers = append(headers.Headers, headerBytes)
 	}
+	return headers, nil
+}
 
-	tx, err := n.pool.ConstructTransaction(sendPubkey, receivePubkey, tc.Amount, tc.Fee)
-	if err != nil {
-		return nil, err
+func (n *Node) GetBlocks(request *pb.BlocksRequest, stream pb.BroadcastService_GetBlocksServer) error {
+	if len(request.Hashes) > maxBlocksPerRequest {
+		misbehaving(remoteAddr(stream.Context()), peer.SCORE_FLOOD, "too many blocks requested")
+		return fmt.Errorf("too many blocks requested")
+	}
+	for _, hash := range request.Hashes {
+		if len(hash) != len(pri.HashResult{}) {
+			misbehaving(remoteAddr(stream.Context()), peer.SCORE_UNDECODABLE, "invalid block hash")
+			return fmt.Errorf("invalid block hash")
+		}
+		block := n.pool.GetBlockByHash(pri.HashResult(hash))
+		if block == nil {
+			return fmt.Errorf("block %x not found", hash)
+		}
+		blockBytes, err := pri.Serialize(block)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.Block{Block: blockBytes}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) Inventory(ctx context.Context, inv *pb.Inv) (*empty.Empty, error) {
+	if inv.From == nil {
+		return nil, fmt.Errorf("missing sender address")
+	}
+	// The items are only fetched from a peer we are connected to,
+	// so that no caller can make the node dial an address of its choice
+	sender := announcer(ctx, inv.From)
+	if sender == nil {
+		return &empty.Empty{}, nil
+	}
+
+	wanted := &pb.Inv{From: selfAddress(n.pool)}
+	for _, item := range inv.Items {
+		if len(item.Hash) != len(pri.HashResult{}) {
+			misbehaving(remoteAddr(ctx), peer.SCORE_UNDECODABLE, "invalid inventory hash")
+			return nil, fmt.Errorf("invalid inventory hash")
+		}
+		hash := pri.HashResult(item.Hash)
+		sender.Known.Add(hash)
+		if hasInventory(n.pool, item) || !markRequested(hash) {
+			continue
+		}
+		wanted.Items = append(wanted.Items, item)
 	}
 
-	txBytes, _ := pri.Serialize(tx)
-	return &pb.Transaction{
-		Transaction: txBytes,
-	}, nil
+	if len(wanted.Items) > 0 {
+		n.taskPool.AddTask(
+			&taskpool.Task{
+				Handler: func(params ...interface{}) {
+					n.fetchInventory(sender, wanted)
+				},
+			},
+		)
+	}
+	return &empty.Empty{}, nil
+}
+
+func (n *Node) GetData(inv *pb.Inv, stream pb.BroadcastService_GetDataServer) error {
+	for _, item := range inv.Items {
+		if len(item.Hash) != len(pri.HashResult{}) {
+			misbehaving(remoteAddr(stream.Context()), peer.SCORE_UNDECODABLE, "invalid inventory hash")
+			return fmt.Errorf("invalid inventory hash")
+		}
+		hash := pri.HashResult(item.Hash)
+
+		var data []byte
+		var err error
+		switch item.Type {
+		case pb.InvType_INV_TX:
+			tx := n.pool.GetTransaction(hash)
+			if tx == nil {
+				continue
+			}
+			data, err = pri.Serialize(tx)
+		case pb.InvType_INV_BLOCK:
+			block := n.pool.GetBlockByHash(hash)
+			if block == nil {
+				continue
+			}
+			data, err = pri.Serialize(block)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := stream.Send(&pb.InvData{Type: item.Type, Data: data}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (n *Node) RequestTransactionsByPublicKey(
@@ -274,8 +433,16 @@ func (n *Node) RequestTransactionsByPublicKey(
 		if err != nil {
 			return err
 		}
+		proof, err := block.GetMerkleProof(i)
+		if err != nil {
+			return err
+		}
+		proofBytes := pri.EncodeProof(proof)
 		for _, idx := range tx.RelatesTo(*pubkey, true) {
-			amount := n.pool.GetTxAmount(tx.GetTxIns()[idx])
+			amount, err := n.pool.GetTxAmount(tx.GetTxIns()[idx])
+			if err != nil {
+				return err
+			}
 			err = stream.Send(&pb.TransactionInfo{
 				BlockHeight:      request.BlockHeight,
 				BlockHash:        request.BlockHash,
@@ -284,7 +451,7 @@ func (n *Node) RequestTransactionsByPublicKey(
 				InOutIdx:         uint32(idx),
 				IsTxIn:           true,
 				Amount:           amount,
-				MerkleProof:      nil,
+				MerkleProof:      proofBytes,
 			})
 			counter += 1
 			if err != nil {
@@ -302,7 +469,7 @@ func (n *Node) RequestTransactionsByPublicKey(
 				InOutIdx:         uint32(idx),
 				IsTxIn:           false,
 				Amount:           amount,
-				MerkleProof:      nil,
+				MerkleProof:      proofBytes,
 			})
 			counter += 1
 			if err != nil {
@@ -324,150 +491,161 @@ func newNode(pool *mempool.Mempool) *Node {
 }
 
 // Client definition
-func broadcastTransaction(tx *pb.Transaction) {
-	var wg sync.WaitGroup
-	wg.Add(len(clients))
-	for _, client := range clients {
-		go func(client pb.BroadcastServiceClient) {
-			defer wg.Done()
-			client.BroadcastTransaction(context.Background(), tx)
-		}(client)
-	}
-	wg.Wait()
+// The function exchanges versions with a new peer, rejects it if it is
+// incompatible, and syncs with it if its chain has more work than ours.
+func handshake(p *peer.Peer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), peer.REQUEST_TIMEOUT)
+	defer cancel()
+	remote, err := p.Client.Handshake(ctx, selfVersion(pool))
+	if err != nil {
+		return err
+	}
+	if err := peer.CheckVersion(remote); err != nil {
+		return err
+	}
+	p.Type = remote.NodeType
+	p.Services = remote.Services
+	p.SetBestHeight(remote.BestHeight)
+	remoteWork := new(big.Int).SetBytes(remote.TotalWork)
+	log.Printf("Connected to %s (%v, version %d), height %d, tip %x, work %v\n",
+		p.Addr, remote.NodeType, remote.ProtocolVersion, remote.BestHeight, remote.TipHash, remoteWork)
+
+	// A wallet has no chain to share, nor addresses
+	if remote.NodeType != pb.NodeType_FULL_NODE {
+		return nil
+	}
+	if remoteWork.Cmp(pool.GetTotalWork()) > 0 && p.HasServices(peer.SERVICE_BLOCKS) {
+		startSync(p)
+	}
+	go exchangeAddrs(p)
+	return nil
 }
 
-func broadcastBlock(height uint32, block *pri.Block, pool *mempool.Mempool) {
-	var wg sync.WaitGroup
-	wg.Add(len(clients))
-	log.Println(clients)
-	for addr, client := range clients {
-		go func(client pb.BroadcastServiceClient, addr string) {
-			defer wg.Done()
-
-			log.Printf("Send block %d to %s\n", height, addr)
-			stream, err := client.BroadcastBlock(context.Background())
-			if err != nil {
-				log.Println(err)
-				log.Printf("Failed to send block %d to %s\n", height, addr)
-				return
-			}
-			defer stream.CloseSend()
-
-			blockBytes, err := pri.Serialize(block)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			msg := &pb.Block{
-				Block:       blockBytes,
-				BlockHeight: height,
-				HeaderOnly:  false,
-			}
-
-			err = stream.Send(msg)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			for {
-				request, err := stream.Recv() // TODO, what if the peer is down?
-				if err != nil {
-					log.Println(err)
-					break
-				}
-
-				if request.BlockHeight > height {
-					log.Printf("Peer %s has a higher block height %d, aborting\n", addr, request.BlockHeight)
-					break
-				}
-
-				the_block := pool.GetBlock(request.BlockHeight)
-				if the_block == nil {
-					log.Printf("Peer %s has a lower block height %d, aborting\n", addr, request.BlockHeight)
-					break
-				}
-
-				var the_block_bytes []byte
-				if request.HeaderOnly {
-					the_block_bytes, err = pri.Serialize(the_block.GetHeader())
-				} else {
-					the_block_bytes, err = pri.Serialize(the_block)
-				}
-
-				if err != nil {
-					log.Println(err)
-					break
-				}
-
-				msg = &pb.Block{
-					Block:       the_block_bytes,
-					BlockHeight: request.BlockHeight,
-					HeaderOnly:  request.HeaderOnly,
-				}
-
-				err = stream.Send(msg)
-				if err != nil {
-					log.Println(err)
-					break
-				}
-			}
-
-		}(client, addr)
+// The version of this node, as sent in handshakes.
+func selfVersion(pool *mempool.Mempool) *pb.Version {
+	height, tip := pool.GetLatestInfo()
+	hash := pri.Hash(tip)
+	return &pb.Version{
+		ProtocolVersion: peer.PROTOCOL_VERSION,
+		Network:         peer.NETWORK_MAGIC,
+		NodeType:        pb.NodeType_FULL_NODE,
+		Services:        peer.SERVICE_BLOCKS | peer.SERVICE_RELAY,
+		Addr:            &pb.Address{Ip: *ip, Port: *port},
+		BestHeight:      height,
+		TipHash:         hash[:],
+		TotalWork:       pool.GetTotalWork().Bytes(),
 	}
-	wg.Wait()
 }
 
-func connect(addr string) {
-	if _, ok := clients[addr]; ok {
-		return
-	}
-	log.Printf("Connecting to %s\n", addr)
-	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Printf("Failed to connect to %s: %v", addr, err)
-		return
+// The address of this node, together with its best
+// height and cumulative work, as sent in inventories.
+func selfAddress(pool *mempool.Mempool) *pb.Address {
+	height, _ := pool.GetLatestInfo()
+	return &pb.Address{
+		Ip:         *ip,
+		Port:       *port,
+		BestHeight: height,
+		TotalWork:  pool.GetTotalWork().Bytes(),
 	}
-	clients[addr] = pb.NewBroadcastServiceClient(conn)
-	clients[addr].Handshake(context.Background(), &pb.Address{
-		Ip:   *ip,
-		Port: *port,
-	})
 }
 
 func main() {
 	// Parse command line options
 	flag.Var(&peers, "peer", "Peer to connect to")
+	flag.Var(&payouts, "payout", "Public key in hex to pay mined blocks to, the keys are paid in turn if repeated")
+	flag.Var(&miningAllow, "miningallow", "IP or CIDR range of hosts allowed to use the mining service besides the local host, can be repeated")
 	flag.Parse()
 
-	pool := mempool.NewMempool(*dir, (uint32)(*difficulty))
+	var err error
+	params, err = chaincfg.Get(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	params.Apply()
+	if *port == "" {
+		*port = params.DefaultPort
+	}
+	*dir = params.DataDir(*dir)
+	log.Printf("Running on %s, data in %s\n", params.Name, *dir)
+
+	if *reindex {
+		if err := mempool.Reindex(*dir); err != nil {
+			log.Fatalf("failed to reindex: %v", err)
+		}
+	}
+	mempool.REPLACE_BY_FEE = *rbf
+	miningAllowed, err := parseAllowlist(miningAllow)
+	if err != nil {
+		log.Fatalf("invalid -miningallow: %v", err)
+	}
+	keys, err := payoutKeys()
+	if err != nil {
+		log.Fatalf("failed to load the payout keys: %v", err)
+	}
+	// Without payout keys, the daemon pays a key kept in dir/wallets
+	pool = mempool.NewMempool(*dir, keys...)
+	blockMiner = miner.New(miner.NewPoolBackend(pool, func(block *pri.Block) {
+		relayInventory(blockInventory(pri.Hash(block)))
+	}))
+
+	addrBook, err = peer.NewAddrBook(filepath.Join(*dir, "peers.json"))
+	if err != nil {
+		log.Fatalf("failed to load the address book: %v", err)
+	}
+	banList, err = peer.NewBanList(filepath.Join(*dir, "banlist.json"))
+	if err != nil {
+		log.Fatalf("failed to load the ban list: %v", err)
+	}
+	peerManager = peer.NewManager(*maxInbound, *maxOutbound, addrBook, banList, handshake)
 
 	addr := net.JoinHostPort(*ip, *port)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(unaryInterceptor),
+		grpc.StreamInterceptor(streamInterceptor),
+	)
 	pb.RegisterBroadcastServiceServer(grpcServer, newNode(pool))
+	pb.RegisterAdminServiceServer(grpcServer, &Admin{})
+	pb.RegisterMiningServiceServer(grpcServer, &MiningService{allowed: miningAllowed})
 	go grpcServer.Serve(lis)
 
+	peerManager.Run()
+	go gossipAddrs()
 	for _, host := range peers {
-		go connect(host)
+		peerManager.AddPersistent(host)
 	}
 
-	for {
-		height, _ := pool.GetLatestInfo()
-		log.Printf("Mining a block %d...\n", height+1)
-		pool.Mine()
-		height, _ = pool.GetLatestInfo()
-		log.Printf("Mined a block, trying to append it to the chain at height %d.\n", height)
-		err := pool.AppendBlock(nil)
-		if err != nil {
-			log.Println(err)
-			continue
+	// On regtest, blocks are generated through the admin service
+	if *mine && !params.GenerateOnDemand {
+		blockMiner.Start(*workers)
+	}
+
+	go func() {
+		for range time.Tick(mempoolSaveInterval) {
+			if err := pool.Save(); err != nil {
+				log.Printf("Failed to save the mempool: %v\n", err)
+			}
 		}
-		height, block := pool.GetLatestInfo()
-		go broadcastBlock(height, block, pool)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	shutdown()
+}
+
+// The function saves the pending transactions and closes the chain
+// state, so that the next start picks up where this one left off.
+func shutdown() {
+	log.Printf("Shutting down\n")
+	blockMiner.Stop()
+	if err := pool.Save(); err != nil {
+		log.Printf("Failed to save the mempool: %v\n", err)
+	}
+	if err := pool.Close(); err != nil {
+		log.Printf("Failed to close the chain state: %v\n", err)
 	}
 }
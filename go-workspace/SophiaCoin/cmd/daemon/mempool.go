@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os-project/SophiaCoin/pkg/mempool"
+	pri "os-project/SophiaCoin/pkg/primitives"
+
+	"github.com/golang/protobuf/ptypes/empty"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+// The function turns a pending transaction of the pool into an entry,
+// with the transaction itself if withTx is set.
+func mempoolEntry(info *mempool.TxInfo, withTx bool) (*pb.MempoolEntry, error) {
+	entry := &pb.MempoolEntry{
+		Hash:  info.Hash[:],
+		Fee:   info.Fee,
+		Size:  uint32(info.Size),
+		Added: info.Added.Unix(),
+	}
+	for i := range info.Depends {
+		entry.Depends = append(entry.Depends, info.Depends[i][:])
+	}
+	if withTx {
+		txBytes, err := pri.Serialize(info.Tx)
+		if err != nil {
+			return nil, err
+		}
+		entry.Transaction = txBytes
+	}
+	return entry, nil
+}
+
+func (n *Node) GetMempool(ctx context.Context, _ *empty.Empty) (*pb.MempoolEntries, error) {
+	entries := &pb.MempoolEntries{}
+	for _, info := range n.pool.GetPending() {
+		entry, err := mempoolEntry(&info, false)
+		if err != nil {
+			return nil, err
+		}
+		entries.Entries = append(entries.Entries, entry)
+	}
+	return entries, nil
+}
+
+func (n *Node) GetMempoolEntry(ctx context.Context, request *pb.MempoolEntryRequest) (*pb.MempoolEntry, error) {
+	if len(request.Hash) != len(pri.HashResult{}) {
+		return nil, fmt.Errorf("invalid hash")
+	}
+	info := n.pool.GetPendingInfo(pri.HashResult(request.Hash))
+	if info == nil {
+		return nil, fmt.Errorf("transaction %x not in the mempool", request.Hash)
+	}
+	return mempoolEntry(info, true)
+}
+
+func (n *Node) GetMempoolInfo(ctx context.Context, _ *empty.Empty) (*pb.MempoolInfo, error) {
+	info := n.pool.GetMempoolInfo()
+	return &pb.MempoolInfo{
+		Count:       uint32(info.Count),
+		Size:        uint64(info.Size),
+		TotalFee:    info.Fees,
+		MaxSize:     uint64(info.MaxSize),
+		MinRelayFee: mempool.MIN_RELAY_FEE,
+	}, nil
+}
+
+func (n *Node) SubscribeMempool(_ *empty.Empty, stream pb.BroadcastService_SubscribeMempoolServer) error {
+	events, cancel := n.pool.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return fmt.Errorf("subscriber too slow, events dropped")
+			}
+			entry, err := mempoolEntry(&event.Info, false)
+			if err != nil {
+				return err
+			}
+			result := &pb.MempoolEvent{Entry: entry}
+			if event.Type == mempool.TxRemoved {
+				result.Type = pb.MempoolEventType_TX_REMOVED
+				result.Reason = string(event.Reason)
+			}
+			if err := stream.Send(result); err != nil {
+				return err
+			}
+		}
+	}
+}
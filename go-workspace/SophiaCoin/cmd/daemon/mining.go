@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os-project/SophiaCoin/pkg/crypto"
+	"os-project/SophiaCoin/pkg/mempool"
+	pri "os-project/SophiaCoin/pkg/primitives"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+// The mining service lets miners in other processes mine on the pool
+// of the node, see cmd/miner. It is only served to the local host and
+// to the hosts allowed by -miningallow.
+type MiningService struct {
+	pb.UnimplementedMiningServiceServer
+	allowed []*net.IPNet
+}
+
+// The function parses IP addresses and CIDR ranges.
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+	result := []*net.IPNet{}
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or range %q", entry)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// The function accepts requests from the local host and the allowed hosts.
+func (s *MiningService) checkMiner(ctx context.Context) error {
+	if checkLocal(ctx) == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(remoteAddr(ctx))
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range s.allowed {
+			if ipNet.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("mining requests are not accepted from %s", host)
+}
+
+// The function turns a template of the pool into one paying the payout
+// key, or the key of the node if it is empty.
+func blockTemplate(template *mempool.BlockTemplate, payoutKey []byte) (*pb.BlockTemplate, error) {
+	transactions := template.Block.GetTransactions()
+	if len(payoutKey) == 0 {
+		payoutKey = transactions[0].GetTxOuts()[0].GetPubKey().ToBytes()
+	} else if _, err := crypto.FromBytes(payoutKey); err != nil {
+		return nil, fmt.Errorf("invalid payout key: %v", err)
+	}
+
+	prev := template.Block.GetHeader().GetPrevHash()
+	result := &pb.BlockTemplate{
+		PrevHash:     prev[:],
+		Height:       template.Height,
+		Difficulty:   template.Difficulty,
+		MinTimestamp: template.MinTime,
+		PayoutKey:    payoutKey,
+		Fees:         template.Fees,
+	}
+	for i := range transactions[1:] {
+		txBytes, err := pri.Serialize(&transactions[1+i])
+		if err != nil {
+			return nil, err
+		}
+		result.Transactions = append(result.Transactions, txBytes)
+	}
+	return result, nil
+}
+
+func (s *MiningService) GetBlockTemplate(ctx context.Context, request *pb.BlockTemplateRequest) (*pb.BlockTemplate, error) {
+	if err := s.checkMiner(ctx); err != nil {
+		return nil, err
+	}
+	return blockTemplate(pool.GetBlockTemplate(), request.PayoutKey)
+}
+
+func (s *MiningService) SubscribeBlockTemplates(request *pb.BlockTemplateRequest,
+	stream pb.MiningService_SubscribeBlockTemplatesServer) error {
+	if err := s.checkMiner(stream.Context()); err != nil {
+		return err
+	}
+	for {
+		template := pool.GetBlockTemplate()
+		result, err := blockTemplate(template, request.PayoutKey)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(result); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-template.Changed:
+		}
+	}
+}
+
+func (s *MiningService) SubmitBlock(ctx context.Context, request *pb.Block) (*pb.SubmitBlockResult, error) {
+	if err := s.checkMiner(ctx); err != nil {
+		return nil, err
+	}
+	block, err := pri.Deserialize(request.Block)
+	block_, ok := block.(*pri.Block)
+	if !ok || err != nil {
+		return &pb.SubmitBlockResult{Reason: "invalid block"}, nil
+	}
+
+	hash := pri.Hash(block_)
+	status, err := pool.ProcessBlock(block_)
+	if err != nil {
+		return &pb.SubmitBlockResult{Reason: err.Error()}, nil
+	}
+	if status != mempool.BlockConnected {
+		return &pb.SubmitBlockResult{Reason: "the block does not extend the chain"}, nil
+	}
+	log.Printf("Block %x submitted by %s\n", hash, remoteAddr(ctx))
+	relayInventory(blockInventory(hash))
+	return &pb.SubmitBlockResult{Accepted: true}, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os-project/SophiaCoin/pkg/mempool"
+	"os-project/SophiaCoin/pkg/peer"
+	"strings"
+
+	"google.golang.org/grpc"
+	grpcPeer "google.golang.org/grpc/peer"
+)
+
+// The function returns the address the request comes from.
+func remoteAddr(ctx context.Context) string {
+	p, ok := grpcPeer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+func misbehaving(addr string, score int, reason string) {
+	if addr != "" {
+		peerManager.Misbehaving(addr, score, reason)
+	}
+}
+
+// The function raises the score of the sender of a block or headers
+// the pool rejected, if no honest node would have sent them.
+func checkBlockError(addr string, err error) {
+	if errors.Is(err, mempool.ErrInvalidProofOfWork) {
+		misbehaving(addr, peer.SCORE_INVALID_POW, err.Error())
+	} else if errors.Is(err, mempool.ErrInvalidMerkleRoot) {
+		misbehaving(addr, peer.SCORE_INVALID_MERKLE_ROOT, err.Error())
+	}
+}
+
+// The function turns away the requests of banned hosts and of hosts
+// flooding us. The admin service and the local host, whose wallets
+// request the records of every block, are not counted.
+func checkRequest(ctx context.Context, method string) error {
+	addr := remoteAddr(ctx)
+	if addr == "" || strings.HasPrefix(method, "/rpc.AdminService/") || checkLocal(ctx) == nil {
+		return nil
+	}
+	if peerManager.IsBanned(addr) {
+		return fmt.Errorf("%s is banned", addr)
+	}
+	return peerManager.CountRequest(addr)
+}
+
+func unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkRequest(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	if err := checkRequest(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os-project/SophiaCoin/pkg/crypto"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Serializes the writes of the payout file
+var payoutFileLock sync.Mutex
+
+// The function decodes a public key given in hex.
+func parsePayoutKey(s string) (*crypto.PublicKey, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid payout key %q: %v", s, err)
+	}
+	key, err := crypto.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payout key %q: %v", s, err)
+	}
+	return key, nil
+}
+
+// The function reads the payout keys from a file, one key in hex
+// per line. Empty lines and lines starting with # are skipped.
+func loadPayoutFile(path string) ([]*crypto.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := []*crypto.PublicKey{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parsePayoutKey(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// The function replaces the payout file by the keys, so that they are
+// paid again after a restart. The file is replaced at once, a crash
+// leaves either the old keys or the new ones.
+func savePayoutFile(path string, keys []*crypto.PublicKey) error {
+	payoutFileLock.Lock()
+	defer payoutFileLock.Unlock()
+
+	var data bytes.Buffer
+	data.WriteString("# Payout keys, written by setpayout\n")
+	for _, key := range keys {
+		fmt.Fprintf(&data, "%x\n", key.ToBytes())
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// The function returns the payout keys given by -payoutfile and -payout,
+// or none if the daemon should pay its own key. A -payout key already in
+// the file, e.g. saved by setpayout, is not paid twice.
+func payoutKeys() ([]*crypto.PublicKey, error) {
+	keys := []*crypto.PublicKey{}
+	if *payoutFile != "" {
+		fileKeys, err := loadPayoutFile(*payoutFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	for _, s := range payouts {
+		key, err := parsePayoutKey(s)
+		if err != nil {
+			return nil, err
+		}
+		if !containsKey(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func containsKey(keys []*crypto.PublicKey, key *crypto.PublicKey) bool {
+	for _, other := range keys {
+		if bytes.Equal(other.ToBytes(), key.ToBytes()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os-project/SophiaCoin/pkg/peer"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"sync"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+const (
+	maxHeaders          = 512 // headers returned by one GetHeaders
+	maxBlocksPerRequest = 16  // blocks requested by one GetBlocks
+)
+
+var (
+	syncing     = map[string]bool{} // addresses of the peers being synced with
+	syncingLock sync.Mutex
+)
+
+// The function syncs with the peer on a goroutine of its own, unless a
+// sync with it is running already.
+func startSync(p *peer.Peer) {
+	syncingLock.Lock()
+	defer syncingLock.Unlock()
+
+	if syncing[p.Addr] {
+		return
+	}
+	syncing[p.Addr] = true
+	go func() {
+		defer func() {
+			syncingLock.Lock()
+			defer syncingLock.Unlock()
+			delete(syncing, p.Addr)
+		}()
+		syncWith(p)
+	}()
+}
+
+// The function downloads the chain of the peer, when it has more work than
+// ours. Headers are requested first and checked for linkage and proof of
+// work, then the bodies are downloaded from all the peers in parallel and
+// added in order.
+func syncWith(p *peer.Peer) {
+	addr := p.Addr
+	log.Printf("Syncing with %s\n", addr)
+
+	var last *pri.HashResult
+	for {
+		// Continue after the last header, which may be on a branch
+		// that has not overtaken our chain yet
+		locator := pool.GetLocator()
+		if last != nil {
+			locator = append([]pri.HashResult{*last}, locator...)
+		}
+		request := &pb.HeadersRequest{}
+		for _, hash := range locator {
+			request.Locator = append(request.Locator, hash[:])
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), peer.REQUEST_TIMEOUT)
+		response, err := p.Client.GetHeaders(ctx, request)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to get headers from %s: %v\n", addr, err)
+			return
+		}
+		if len(response.Headers) == 0 {
+			break
+		}
+		headers := make([]*pri.BlockHeader, 0, len(response.Headers))
+		for _, headerBytes := range response.Headers {
+			header, err := pri.Deserialize(headerBytes)
+			header_, ok := header.(*pri.BlockHeader)
+			if !ok || err != nil {
+				log.Printf("Invalid header from %s\n", addr)
+				peerManager.Misbehaving(addr, peer.SCORE_UNDECODABLE, "undecodable header")
+				return
+			}
+			headers = append(headers, header_)
+		}
+
+		needed, err := pool.CheckHeaders(headers)
+		if err != nil {
+			log.Printf("Invalid headers from %s: %v\n", addr, err)
+			checkBlockError(addr, err)
+			return
+		}
+		log.Printf("Received %d headers from %s, downloading %d blocks\n", len(headers), addr, len(needed))
+
+		blocks := downloadBlocks(p, needed)
+		for _, hash := range needed {
+			block, ok := blocks[hash]
+			if !ok {
+				log.Printf("Failed to download block %x\n", hash)
+				return
+			}
+			if _, err := pool.ProcessBlock(block); err != nil {
+				log.Printf("Invalid block %x from %s: %v\n", hash, addr, err)
+				checkBlockError(addr, err)
+				return
+			}
+		}
+
+		hash := pri.Hash(headers[len(headers)-1])
+		last = &hash
+		if len(headers) < maxHeaders {
+			break
+		}
+	}
+
+	height, _ := pool.GetLatestInfo()
+	log.Printf("Synced with %s, height %d\n", addr, height)
+}
+
+// The function downloads the blocks in batches spread over the connected
+// peers. A batch a peer fails to send is requested from the sync peer.
+func downloadBlocks(p *peer.Peer, hashes []pri.HashResult) map[pri.HashResult]*pri.Block {
+	peers := []*peer.Peer{p}
+	for _, other := range peerManager.Peers() {
+		if other.Addr != p.Addr && other.HasServices(peer.SERVICE_BLOCKS) {
+			peers = append(peers, other)
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	blocks := map[pri.HashResult]*pri.Block{}
+	for i := 0; i*maxBlocksPerRequest < len(hashes); i++ {
+		end := (i + 1) * maxBlocksPerRequest
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := hashes[i*maxBlocksPerRequest : end]
+		other := peers[i%len(peers)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := getBlocks(other, batch)
+			if err != nil && other != p {
+				result, err = getBlocks(p, batch)
+			}
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, block := range result {
+				blocks[pri.Hash(block)] = block
+			}
+		}()
+	}
+	wg.Wait()
+	return blocks
+}
+
+// The function requests the blocks from the peer, which must send all of
+// them in order. Their headers have been checked already, so the peer
+// is blamed for a body not matching its merkle root.
+func getBlocks(p *peer.Peer, hashes []pri.HashResult) ([]*pri.Block, error) {
+	request := &pb.BlocksRequest{}
+	for _, hash := range hashes {
+		request.Hashes = append(request.Hashes, hash[:])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), peer.REQUEST_TIMEOUT)
+	defer cancel()
+	stream, err := p.Client.GetBlocks(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []*pri.Block{}
+	for _, hash := range hashes {
+		response, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		block, err := pri.Deserialize(response.Block)
+		block_, ok := block.(*pri.Block)
+		if !ok || err != nil {
+			peerManager.Misbehaving(p.Addr, peer.SCORE_UNDECODABLE, "undecodable block")
+			return nil, fmt.Errorf("invalid block instead of %x", hash)
+		}
+		if pri.Hash(block_) != hash {
+			return nil, fmt.Errorf("unexpected block instead of %x", hash)
+		}
+		if !block_.VerifyMerkleRoot() {
+			peerManager.Misbehaving(p.Addr, peer.SCORE_INVALID_MERKLE_ROOT, "invalid merkle root")
+			return nil, fmt.Errorf("invalid merkle root of block %x", hash)
+		}
+		blocks = append(blocks, block_)
+	}
+	return blocks, nil
+}
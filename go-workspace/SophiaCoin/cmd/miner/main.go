@@ -0,0 +1,180 @@
+package main
+
+// A miner running apart from the daemon. It gets block templates from
+// the mining service of a daemon, builds the blocks itself, and submits
+// the blocks it finds.
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os-project/SophiaCoin/pkg/chaincfg"
+	"os-project/SophiaCoin/pkg/crypto"
+	"os-project/SophiaCoin/pkg/mempool"
+	"os-project/SophiaCoin/pkg/miner"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"runtime"
+	"sync"
+	"time"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	// Command line options
+	daemon  = flag.String("daemon", "", "Daemon to mine for, 127.0.0.1 at the default port of the network if empty")
+	network = flag.String("network", "mainnet", "Network of the daemon: mainnet, testnet or regtest")
+	payout  = flag.String("payout", "", "Public key (hex) the mined blocks pay to, the key of the daemon if empty")
+	workers = flag.Int("miners", runtime.NumCPU(), "Number of mining goroutines")
+)
+
+// The backend keeps the last template sent by the daemon.
+type remoteBackend struct {
+	client    pb.MiningServiceClient
+	payoutKey []byte
+
+	lock     sync.Mutex
+	template *mempool.BlockTemplate // nil when not subscribed
+	changed  chan struct{}
+}
+
+// The function turns a template of the daemon into a block to mine.
+func newTemplate(template *pb.BlockTemplate, changed chan struct{}) (*mempool.BlockTemplate, error) {
+	if len(template.PrevHash) != len(pri.HashResult{}) {
+		return nil, fmt.Errorf("invalid previous hash")
+	}
+	payoutKey, err := crypto.FromBytes(template.PayoutKey)
+	if err != nil {
+		return nil, err
+	}
+	transactions := []pri.Transaction{}
+	for _, txBytes := range template.Transactions {
+		tx, err := pri.Deserialize(txBytes)
+		if err != nil {
+			return nil, err
+		}
+		tx_, ok := tx.(*pri.Transaction)
+		if !ok {
+			return nil, fmt.Errorf("invalid transaction")
+		}
+		transactions = append(transactions, *tx_)
+	}
+
+	block := pri.NewBlock(pri.HashResult(template.PrevHash), template.Height, payoutKey, template.Fees, transactions...)
+	if block.GetHeader().GetTimestamp() < template.MinTimestamp {
+		block.GetHeader().SetTimestamp(template.MinTimestamp)
+	}
+	return &mempool.BlockTemplate{
+		Block:      block,
+		Height:     template.Height,
+		Difficulty: template.Difficulty,
+		Fees:       template.Fees,
+		MinTime:    template.MinTimestamp,
+		Changed:    changed,
+	}, nil
+}
+
+// The function receives the templates of the daemon, and
+// subscribes again whenever the subscription breaks.
+func (b *remoteBackend) subscribe() {
+	for {
+		stream, err := b.client.SubscribeBlockTemplates(context.Background(),
+			&pb.BlockTemplateRequest{PayoutKey: b.payoutKey})
+		for err == nil {
+			var template *pb.BlockTemplate
+			template, err = stream.Recv()
+			if err != nil {
+				break
+			}
+			changed := make(chan struct{})
+			next, invalid := newTemplate(template, changed)
+			if invalid != nil {
+				log.Printf("Invalid template: %v\n", invalid)
+			}
+			b.set(next, changed)
+			if next != nil {
+				log.Printf("New template at height %d, difficulty %d, %d transactions\n",
+					template.Height, template.Difficulty, len(template.Transactions))
+			}
+		}
+		log.Printf("Lost the template subscription: %v, retrying\n", err)
+		b.set(nil, make(chan struct{}))
+		time.Sleep(time.Second)
+	}
+}
+
+func (b *remoteBackend) set(template *mempool.BlockTemplate, changed chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	close(b.changed)
+	b.template = template
+	b.changed = changed
+}
+
+func (b *remoteBackend) GetBlockTemplate() (*mempool.BlockTemplate, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.template == nil {
+		return nil, fmt.Errorf("no template yet")
+	}
+	template := *b.template
+	template.Block = b.template.Block.Copy()
+	return &template, nil
+}
+
+func (b *remoteBackend) SubmitBlock(block *pri.Block) error {
+	blockBytes, err := pri.Serialize(block)
+	if err != nil {
+		return err
+	}
+	result, err := b.client.SubmitBlock(context.Background(), &pb.Block{Block: blockBytes})
+	if err != nil {
+		return err
+	}
+	if !result.Accepted {
+		return fmt.Errorf("%s", result.Reason)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	params, err := chaincfg.Get(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	params.Apply()
+	if *daemon == "" {
+		*daemon = net.JoinHostPort("127.0.0.1", params.DefaultPort)
+	}
+	payoutKey, err := hex.DecodeString(*payout)
+	if err != nil {
+		log.Fatalf("invalid payout key: %v", err)
+	}
+
+	conn, err := grpc.Dial(*daemon, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("failed to connect to %s: %v", *daemon, err)
+	}
+	backend := &remoteBackend{
+		client:    pb.NewMiningServiceClient(conn),
+		payoutKey: payoutKey,
+		changed:   make(chan struct{}),
+	}
+	go backend.subscribe()
+
+	m := miner.New(backend)
+	m.Start(*workers)
+	for range time.Tick(30 * time.Second) {
+		log.Printf("Hash rate: %d H/s\n", m.HashRate())
+	}
+}
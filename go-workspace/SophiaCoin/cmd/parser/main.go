@@ -4,29 +4,70 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os-project/SophiaCoin/pkg/blockstore"
+	"os-project/SophiaCoin/pkg/chaincfg"
 	pri "os-project/SophiaCoin/pkg/primitives"
+	"path/filepath"
+	"strings"
 )
 
 var (
 	// command line arguments
-	the_file = flag.String("file", "/osdata/osgroup4/SophiaCoin/blocks/Block6.dat", "The file to parse")
+	the_file = flag.String("file", "", "The file to parse, e.g. a block file written by an older version")
+	the_dir  = flag.String("dir", "", "The block store to parse if no file is given, the one of the network under ~/.sophiacoin if empty")
+	network  = flag.String("network", "mainnet", "The network of the block store: mainnet, testnet or regtest")
+	the_hash = flag.String("hash", "", "Only show the blocks whose hash starts with this hex prefix")
 	out_file = flag.String("out", "", "The file to output to")
 )
 
 func main() {
 	flag.Parse()
-	b, err := os.ReadFile(*the_file)
-	if err != nil {
-		panic(err)
-	}
 
-	data, err := pri.Deserialize(b)
-	if err != nil {
-		panic(err)
+	var data []interface{}
+	if *the_file != "" {
+		b, err := os.ReadFile(*the_file)
+		if err != nil {
+			panic(err)
+		}
+		d, err := pri.Deserialize(b)
+		if err != nil {
+			panic(err)
+		}
+		data = append(data, d)
+	} else {
+		if *the_dir == "" {
+			params, err := chaincfg.Get(*network)
+			if err != nil {
+				panic(err)
+			}
+			*the_dir = filepath.Join(params.DataDir(""), "blocks")
+		}
+		err := blockstore.Scan(*the_dir, func(loc blockstore.Location, b []byte) error {
+			d, err := pri.Deserialize(b)
+			if err != nil {
+				return err
+			}
+			if block, ok := d.(*pri.Block); ok {
+				hash := pri.Hash(block)
+				if !strings.HasPrefix(fmt.Sprintf("%x", hash), *the_hash) {
+					return nil
+				}
+			}
+			data = append(data, d)
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	s := fmt.Sprintf("%v", data)
-	os.WriteFile(*out_file, []byte(s), 0644)
+	s := ""
+	for _, d := range data {
+		s += fmt.Sprintf("%v\n", d)
+	}
+	if *out_file != "" {
+		os.WriteFile(*out_file, []byte(s), 0644)
+	}
 
-	fmt.Println(s)
+	fmt.Print(s)
 }
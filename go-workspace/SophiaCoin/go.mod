@@ -7,6 +7,7 @@ require (
 	github.com/fzdwx/infinite v0.12.1
 	github.com/go-gota/gota v0.12.0
 	github.com/golang/protobuf v1.5.3
+	go.etcd.io/bbolt v1.3.8
 	google.golang.org/grpc v1.59.0
 	google.golang.org/protobuf v1.31.0
 )
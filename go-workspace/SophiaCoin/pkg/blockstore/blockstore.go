@@ -0,0 +1,314 @@
+package blockstore
+
+// The block store keeps records in append-only segment files
+// dir/blk00000.dat, dir/blk00001.dat, ... Each record is
+//
+//	magic (4 bytes) | length (4 bytes) | crc32 of data (4 bytes) | data
+//
+// Records are never overwritten. A record is synced to disk before its
+// location is returned, so an index may refer to it right away. A crash
+// while appending leaves at most a torn record at the end of the last
+// segment, which is cut off when the store is opened again. An invalid
+// record followed by more data is corruption, not a crash, and is
+// reported as an error rather than cut off with the records after it.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	recordMagic      uint32 = 0x50534f53 // "SOSP"
+	headerSize              = 12
+	MAX_SEGMENT_SIZE        = int64(128 << 20)
+)
+
+var (
+	// A record holds a serialized block, which starts with its type.
+	// Longer records are neither written nor read, so that a corrupt
+	// length cannot make the store allocate gigabytes.
+	MAX_RECORD_SIZE = uint32(pri.MAX_BLOCK_SIZE + 4)
+)
+
+// The location of a record in the store.
+type Location struct {
+	File   uint32
+	Offset uint32
+	Size   uint32 // size of the data, without the record header
+}
+
+func (loc Location) Serialize() []byte {
+	result := binary.LittleEndian.AppendUint32(nil, loc.File)
+	result = binary.LittleEndian.AppendUint32(result, loc.Offset)
+	return binary.LittleEndian.AppendUint32(result, loc.Size)
+}
+
+func DeserializeLocation(data []byte) (Location, error) {
+	if len(data) != 12 {
+		return Location{}, errors.New("blockstore.DeserializeLocation: Invalid data length")
+	}
+	return Location{
+		File:   binary.LittleEndian.Uint32(data[0:4]),
+		Offset: binary.LittleEndian.Uint32(data[4:8]),
+		Size:   binary.LittleEndian.Uint32(data[8:12]),
+	}, nil
+}
+
+type Store struct {
+	dir  string
+	lock sync.Mutex
+
+	file    *os.File // the last segment, opened for appending
+	fileNum uint32
+	size    int64
+}
+
+func segmentName(dir string, num uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("blk%05d.dat", num))
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var num uint32 = 0
+	for {
+		if _, err := os.Stat(segmentName(dir, num+1)); err != nil {
+			break
+		}
+		num++
+	}
+
+	file, err := os.OpenFile(segmentName(dir, num), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Cut off a torn record left by a crash
+	size, err := scanSegment(file, num, nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Store{
+		dir:     dir,
+		file:    file,
+		fileNum: num,
+		size:    size,
+	}, nil
+}
+
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.file.Close()
+}
+
+// The function returns whether no record has been appended yet.
+func (s *Store) Empty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.fileNum == 0 && s.size == 0
+}
+
+// The function appends the data as a new record and syncs it to disk.
+func (s *Store) Append(data []byte) (Location, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if uint64(len(data)) > uint64(MAX_RECORD_SIZE) {
+		return Location{}, errors.New("blockstore.Store.Append: Record too large")
+	}
+	if s.size > 0 && s.size+int64(headerSize+len(data)) > MAX_SEGMENT_SIZE {
+		if err := s.file.Close(); err != nil {
+			return Location{}, err
+		}
+		file, err := os.OpenFile(segmentName(s.dir, s.fileNum+1), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return Location{}, err
+		}
+		s.file, s.fileNum, s.size = file, s.fileNum+1, 0
+		// The new segment must survive a crash along with its records
+		if err := syncDir(s.dir); err != nil {
+			return Location{}, err
+		}
+	}
+
+	record := binary.LittleEndian.AppendUint32(nil, recordMagic)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(data)))
+	record = binary.LittleEndian.AppendUint32(record, crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return Location{}, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return Location{}, err
+	}
+
+	loc := Location{File: s.fileNum, Offset: uint32(s.size), Size: uint32(len(data))}
+	s.size += int64(len(record))
+	return loc, nil
+}
+
+// The function reads the record at the location and checks its checksum.
+func (s *Store) Read(loc Location) ([]byte, error) {
+	file, err := os.Open(segmentName(s.dir, loc.File))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, _, err := readRecord(file, int64(loc.Offset))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(data)) != loc.Size {
+		return nil, errors.New("blockstore.Store.Read: Record size mismatch")
+	}
+	return data, nil
+}
+
+// The function calls fn on every valid record of every segment, in the
+// order they were appended.
+func (s *Store) Scan(fn func(loc Location, data []byte) error) error {
+	return Scan(s.dir, fn)
+}
+
+// The function scans the store in dir without opening it for appending,
+// so it can be used while another process is appending to the store.
+func Scan(dir string, fn func(loc Location, data []byte) error) error {
+	for num := uint32(0); ; num++ {
+		file, err := os.Open(segmentName(dir, num))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = scanSegment(file, num, fn)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The function reads the records of a segment until the end of the file
+// or a torn record at its end, and returns the size of the valid part.
+func scanSegment(file *os.File, num uint32, fn func(loc Location, data []byte) error) (int64, error) {
+	var offset int64 = 0
+	for {
+		data, size, err := readRecord(file, offset)
+		if err != nil {
+			torn, tornErr := isTorn(file, offset)
+			if tornErr != nil {
+				return offset, tornErr
+			} else if !torn {
+				return offset, fmt.Errorf("blockstore.scanSegment: Corrupt record at offset %d of %s: %v",
+					offset, file.Name(), err)
+			}
+			return offset, nil
+		}
+		if fn != nil {
+			loc := Location{File: num, Offset: uint32(offset), Size: uint32(len(data))}
+			if err := fn(loc, data); err != nil {
+				return offset, err
+			}
+		}
+		offset += size
+	}
+}
+
+// The function reads the record at offset, and returns its data and
+// its total size on disk.
+func readRecord(file *os.File, offset int64) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != recordMagic {
+		return nil, 0, errors.New("blockstore.readRecord: Invalid magic")
+	}
+	length := binary.LittleEndian.Uint32(header[4:8])
+	checksum := binary.LittleEndian.Uint32(header[8:12])
+
+	// Check the length before allocating the data
+	if length > MAX_RECORD_SIZE {
+		return nil, 0, errors.New("blockstore.readRecord: Record too large")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(length) > info.Size()-offset-headerSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+headerSize); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, 0, errors.New("blockstore.readRecord: Checksum mismatch")
+	}
+	return data, int64(headerSize) + int64(length), nil
+}
+
+// The function tells whether the invalid record at offset was torn by
+// a crash, i.e. its header is cut short by the end of the file, or it
+// is a valid header whose data reaches the end of the file. Nothing
+// follows a torn record, since the crash stopped the appending.
+func isTorn(file *os.File, offset int64) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if offset+headerSize > info.Size() {
+		return true, nil
+	}
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return false, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != recordMagic {
+		return false, nil
+	}
+	length := int64(binary.LittleEndian.Uint32(header[4:8]))
+	return offset+headerSize+length >= info.Size(), nil
+}
+
+// The function syncs the directory, so that the files created in it are
+// not lost in a crash.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
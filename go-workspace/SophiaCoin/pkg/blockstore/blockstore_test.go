@@ -0,0 +1,137 @@
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Append([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.Append([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Cut the second record as if the process crashed while writing it
+	if err := os.Truncate(segmentName(dir, 0), int64(second.Offset)+headerSize+2); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if data, err := store.Read(first); err != nil || !bytes.Equal(data, []byte("first")) {
+		t.Fatalf("Read(first) = %q, %v", data, err)
+	}
+	if _, err := store.Read(second); err == nil {
+		t.Fatal("torn record is readable")
+	}
+
+	third, err := store.Append([]byte("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Offset != second.Offset {
+		t.Fatalf("appended at offset %d, want %d", third.Offset, second.Offset)
+	}
+	records := 0
+	store.Scan(func(loc Location, data []byte) error {
+		records++
+		return nil
+	})
+	if records != 2 {
+		t.Fatalf("Scan found %d records, want 2", records)
+	}
+}
+
+func TestOversizedRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.Append([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Append(make([]byte, MAX_RECORD_SIZE+1)); err == nil {
+		t.Fatal("appended a record above MAX_RECORD_SIZE")
+	}
+	store.Close()
+
+	// A header claiming more data than the segment holds, then one
+	// claiming more than MAX_RECORD_SIZE
+	for _, length := range []uint32{100, MAX_RECORD_SIZE + 1, 0xffffffff} {
+		header := binary.LittleEndian.AppendUint32(nil, recordMagic)
+		header = binary.LittleEndian.AppendUint32(header, length)
+		header = binary.LittleEndian.AppendUint32(header, 0)
+		file, err := os.OpenFile(segmentName(dir, 0), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(append(header, "data"...))
+		file.Close()
+
+		loc := Location{File: 0, Offset: first.Size + headerSize, Size: length}
+		store, err = Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Read(loc); err == nil {
+			t.Fatalf("record of length %d is readable", length)
+		}
+		if data, err := store.Read(first); err != nil || !bytes.Equal(data, []byte("first")) {
+			t.Fatalf("Read(first) = %q, %v", data, err)
+		}
+		store.Close()
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locs := []Location{}
+	for _, data := range []string{"first", "second", "third"} {
+		loc, err := store.Append([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, loc)
+	}
+	store.Close()
+
+	// Flip a byte of the second record, the third one follows it
+	file, err := os.OpenFile(segmentName(dir, 0), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{'S'}, int64(locs[1].Offset)+headerSize)
+	info, _ := file.Stat()
+	file.Close()
+
+	if _, err := Open(dir); err == nil {
+		t.Fatal("opened a store with a corrupt record")
+	}
+	if err := Scan(dir, func(loc Location, data []byte) error { return nil }); err == nil {
+		t.Fatal("scanned a store with a corrupt record")
+	}
+	if after, err := os.Stat(segmentName(dir, 0)); err != nil || after.Size() != info.Size() {
+		t.Fatal("the records after a corrupt one are cut off")
+	}
+}
@@ -0,0 +1,145 @@
+package chaincfg
+
+// The parameters of the networks a node can run on. A node runs on a
+// single network, selected on startup, whose parameters are applied to
+// the consensus variables of the primitives package and to the network
+// magic checked in handshakes.
+
+import (
+	"fmt"
+	"os"
+	"os-project/SophiaCoin/pkg/peer"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"path/filepath"
+	"time"
+)
+
+type Params struct {
+	Name        string
+	Magic       uint32 // checked in handshakes, see peer.CheckVersion
+	DefaultPort string
+	DataSubdir  string // under the data directory, so the networks do not share data
+
+	GenesisTimestamp uint64
+	GenesisNonce     uint32
+
+	MinerReward      uint64
+	HalvingInterval  uint32
+	CoinbaseMaturity uint32
+
+	InitialDifficulty uint32
+	RetargetInterval  uint32 // 0 keeps the initial difficulty
+	TargetBlockTime   uint64
+	MaxDifficultyStep uint32
+
+	// Blocks are only mined on request, instead of continuously
+	GenerateOnDemand bool
+}
+
+var MainNet = Params{
+	Name:        "mainnet",
+	Magic:       0x534f5048, // "SOPH"
+	DefaultPort: "51151",
+	DataSubdir:  "",
+
+	GenesisTimestamp: uint64(time.Date(2002, time.November, 11, 18, 12, 0, 0, time.UTC).Unix()),
+	GenesisNonce:     0xdeadbeef,
+
+	MinerReward:      1024,
+	HalvingInterval:  4096,
+	CoinbaseMaturity: 10,
+
+	InitialDifficulty: 4,
+	RetargetInterval:  16,
+	TargetBlockTime:   30,
+	MaxDifficultyStep: 2,
+}
+
+var TestNet = Params{
+	Name:        "testnet",
+	Magic:       0x534f5054, // "SOPT"
+	DefaultPort: "52151",
+	DataSubdir:  "testnet",
+
+	GenesisTimestamp: uint64(time.Date(2023, time.May, 1, 0, 0, 0, 0, time.UTC).Unix()),
+	GenesisNonce:     0x7e57,
+
+	MinerReward:      1024,
+	HalvingInterval:  4096,
+	CoinbaseMaturity: 10,
+
+	InitialDifficulty: 2,
+	RetargetInterval:  16,
+	TargetBlockTime:   10,
+	MaxDifficultyStep: 2,
+}
+
+// Every hash meets the difficulty of regtest, and blocks are only
+// generated on request, so that tests run in seconds.
+var RegTest = Params{
+	Name:        "regtest",
+	Magic:       0x534f5052, // "SOPR"
+	DefaultPort: "53151",
+	DataSubdir:  "regtest",
+
+	GenesisTimestamp: uint64(time.Date(2023, time.May, 1, 0, 0, 0, 0, time.UTC).Unix()),
+	GenesisNonce:     0,
+
+	MinerReward:      1024,
+	HalvingInterval:  150,
+	CoinbaseMaturity: 10,
+
+	InitialDifficulty: 0,
+	RetargetInterval:  0,
+	TargetBlockTime:   1,
+	MaxDifficultyStep: 0,
+
+	GenerateOnDemand: true,
+}
+
+// The function returns the parameters of the network with the given name.
+func Get(name string) (*Params, error) {
+	for _, params := range []*Params{&MainNet, &TestNet, &RegTest} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("chaincfg.Get: Unknown network %s", name)
+}
+
+// The function sets the consensus variables and the network magic to the
+// parameters. It must be called on startup, before any block is handled.
+func (params *Params) Apply() {
+	pri.GENESIS_TIMESTAMP = params.GenesisTimestamp
+	pri.GENESIS_NONCE = params.GenesisNonce
+
+	pri.MINER_REWARD = params.MinerReward
+	pri.HALVING_INTERVAL = params.HalvingInterval
+	pri.COINBASE_MATURITY = params.CoinbaseMaturity
+
+	pri.INITIAL_DIFFICULTY = params.InitialDifficulty
+	pri.RETARGET_INTERVAL = params.RetargetInterval
+	pri.TARGET_BLOCK_TIME = params.TargetBlockTime
+	pri.MAX_DIFFICULTY_STEP = params.MaxDifficultyStep
+
+	peer.NETWORK_MAGIC = params.Magic
+}
+
+// The function returns the directory of the network under dir,
+// or under DefaultDataDir if dir is empty.
+func (params *Params) DataDir(dir string) string {
+	if dir == "" {
+		dir = DefaultDataDir()
+	}
+	return filepath.Join(dir, params.DataSubdir)
+}
+
+// The function returns ~/.sophiacoin, or .sophiacoin in the working
+// directory if the home directory is unknown.
+func DefaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".sophiacoin"
+	}
+	return filepath.Join(home, ".sophiacoin")
+}
@@ -0,0 +1,33 @@
+package chaincfg
+
+import (
+	"testing"
+
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+func TestNetworksDiffer(t *testing.T) {
+	defer MainNet.Apply()
+
+	genesis := map[pri.HashResult]string{}
+	magic := map[uint32]string{}
+	for _, name := range []string{"mainnet", "testnet", "regtest"} {
+		params, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.Apply()
+		hash := pri.Hash(pri.GetGenesisBlock())
+		if other, ok := genesis[hash]; ok {
+			t.Fatalf("%s and %s share the genesis block", name, other)
+		}
+		if other, ok := magic[params.Magic]; ok {
+			t.Fatalf("%s and %s share the magic", name, other)
+		}
+		genesis[hash] = name
+		magic[params.Magic] = name
+	}
+	if _, err := Get("nonet"); err == nil {
+		t.Fatal("an unknown network is accepted")
+	}
+}
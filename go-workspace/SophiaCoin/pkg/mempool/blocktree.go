@@ -0,0 +1,467 @@
+package mempool
+
+// The block tree keeps every block known to build on the genesis block,
+// whether it is on the active chain or on a side branch, and the orphan
+// blocks whose parent is not known yet. The bodies of side branches are
+// kept in the block store. When a side branch gets more work than the
+// active chain, the chain is reorganized to it. Side branches forking more
+// than MAX_FORK_DEPTH blocks below the tip are pruned, as are the invalid
+// blocks that deep.
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"time"
+)
+
+type BlockStatus int
+
+const (
+	BlockConnected  BlockStatus = iota // the block is on the active chain
+	BlockSideBranch                    // the block is on a side branch with no more work than the active chain
+	BlockOrphan                        // the parent of the block is not known yet
+	BlockKnown                         // the block has been processed before
+)
+
+var (
+	MAX_ORPHAN_BLOCKS = 64
+	// Blocks forking from the active chain more than MAX_FORK_DEPTH blocks
+	// below the tip are not accepted, so that the tree does not grow
+	// without bound.
+	MAX_FORK_DEPTH = uint32(100)
+)
+
+// Errors telling that the sender of a block or header misbehaved,
+// as no honest node would send it.
+var (
+	ErrInvalidProofOfWork = errors.New("Invalid proof of work")
+	ErrInvalidMerkleRoot  = errors.New("Invalid merkle root")
+)
+
+type treeNode struct {
+	hash       pri.HashResult
+	header     *pri.BlockHeader
+	parent     *treeNode
+	children   []*treeNode
+	height     uint32
+	difficulty uint32
+	work       *big.Int // cumulative work from the genesis block
+}
+
+type blockTree struct {
+	chain   *Chain
+	nodes   map[pri.HashResult]*treeNode
+	tips    map[*treeNode]bool        // the nodes without children
+	best    *treeNode                 // a tip with the most work
+	invalid map[pri.HashResult]uint32 // hash -> height
+
+	orphans map[pri.HashResult]*pri.Block
+	waiting map[pri.HashResult][]pri.HashResult // parent hash -> orphans waiting for it
+}
+
+func newBlockTree(chain *Chain) *blockTree {
+	tree := &blockTree{
+		chain:   chain,
+		nodes:   map[pri.HashResult]*treeNode{},
+		tips:    map[*treeNode]bool{},
+		invalid: map[pri.HashResult]uint32{},
+		orphans: map[pri.HashResult]*pri.Block{},
+		waiting: map[pri.HashResult][]pri.HashResult{},
+	}
+
+	var parent *treeNode
+	for height := uint32(0); height <= chain.Height(); height++ {
+		node := &treeNode{
+			hash:       pri.Hash(chain.headers[height]),
+			header:     chain.headers[height],
+			parent:     parent,
+			height:     height,
+			difficulty: chain.difficulties[height],
+			work:       chain.works[height],
+		}
+		if parent != nil {
+			parent.children = append(parent.children, node)
+		}
+		tree.nodes[node.hash] = node
+		parent = node
+	}
+	tree.tips[parent] = true
+	tree.best = parent
+	return tree
+}
+
+// The function returns the ancestor of the node at the given height.
+func (node *treeNode) ancestor(height uint32) *treeNode {
+	for node.height > height {
+		node = node.parent
+	}
+	return node
+}
+
+// The function returns the difficulty of a child of the node.
+func (node *treeNode) nextDifficulty() uint32 {
+	return nextDifficulty(node.height+1, node.difficulty, func(h uint32) *pri.BlockHeader {
+		return node.ancestor(h).header
+	})
+}
+
+// The function returns the median timestamp of the node
+// and its last ancestors, as Chain.medianTime does.
+func (node *treeNode) medianTime() uint64 {
+	timestamps := []uint64{}
+	for n := node; n != nil && len(timestamps) < pri.MEDIAN_TIME_SPAN; n = n.parent {
+		timestamps = append(timestamps, n.header.GetTimestamp())
+	}
+	return median(timestamps)
+}
+
+func (tree *blockTree) onChain(node *treeNode) bool {
+	header := tree.chain.GetHeader(node.height)
+	return header != nil && pri.Hash(header) == node.hash
+}
+
+// The function returns the last ancestor of the node on the active chain,
+// or the node itself if it is on the chain.
+func (tree *blockTree) fork(node *treeNode) *treeNode {
+	for !tree.onChain(node) {
+		node = node.parent
+	}
+	return node
+}
+
+// The function returns whether a branch forking at the node is too deep
+// below the tip to be kept.
+func (tree *blockTree) tooDeep(fork *treeNode) bool {
+	return fork.height+MAX_FORK_DEPTH < tree.chain.Height()
+}
+
+func (tree *blockTree) isInvalid(hash pri.HashResult) bool {
+	_, ok := tree.invalid[hash]
+	return ok
+}
+
+// The function adds the block to the tree, connects the orphans waiting
+// for it, and reorganizes the chain if a branch has more work than the
+// active chain.
+func (tree *blockTree) process(block *pri.Block) (BlockStatus, error) {
+	hash := pri.Hash(block)
+	if tree.isInvalid(hash) {
+		return 0, fmt.Errorf("mempool.blockTree.process: Block %x is invalid", hash)
+	}
+	if _, ok := tree.nodes[hash]; ok {
+		return BlockKnown, nil
+	}
+	if _, ok := tree.orphans[hash]; ok {
+		return BlockKnown, nil
+	}
+
+	prev := block.GetHeader().GetPrevHash()
+	if tree.isInvalid(prev) {
+		return 0, fmt.Errorf("mempool.blockTree.process: Block %x builds on an invalid block", hash)
+	}
+	parent, ok := tree.nodes[prev]
+	if !ok {
+		if err := tree.addOrphan(hash, block); err != nil {
+			return 0, err
+		}
+		return BlockOrphan, nil
+	}
+
+	if err := tree.add(parent, block); err != nil {
+		return 0, err
+	}
+
+	// The orphans waiting for the block, and then their own children
+	queue := []pri.HashResult{hash}
+	for len(queue) > 0 {
+		parent := tree.nodes[queue[0]]
+		queue = queue[1:]
+		for _, child := range tree.waiting[parent.hash] {
+			orphan, ok := tree.orphans[child]
+			if !ok {
+				continue
+			}
+			delete(tree.orphans, child)
+			if tree.add(parent, orphan) == nil {
+				queue = append(queue, child)
+			}
+		}
+		delete(tree.waiting, parent.hash)
+	}
+
+	if err := tree.activateBest(); err != nil {
+		return 0, err
+	}
+	tree.prune()
+	node, ok := tree.nodes[hash]
+	if !ok {
+		return 0, fmt.Errorf("mempool.blockTree.process: Block %x is invalid", hash)
+	}
+	if tree.onChain(node) {
+		return BlockConnected, nil
+	}
+	return BlockSideBranch, nil
+}
+
+// The function checks the header of the block against its parent, and
+// stores the block as a child of the parent.
+func (tree *blockTree) add(parent *treeNode, block *pri.Block) error {
+	hash := pri.Hash(block)
+	height := parent.height + 1
+	if tree.tooDeep(tree.fork(parent)) {
+		return fmt.Errorf("mempool.blockTree.add: Block %x forks too far below the tip", hash)
+	}
+	difficulty := parent.nextDifficulty()
+	if !block.VerifyDifficulty(int(height), difficulty) {
+		return fmt.Errorf("mempool.blockTree.add: %w of block %x", ErrInvalidProofOfWork, hash)
+	}
+	// Only blocks with a valid proof of work are remembered as invalid,
+	// so that the set cannot be filled for free.
+	if !block.VerifyMerkleRoot() {
+		tree.invalid[hash] = height
+		return fmt.Errorf("mempool.blockTree.add: %w of block %x", ErrInvalidMerkleRoot, hash)
+	}
+	// A block too far in the future may become valid later, so it is not
+	// remembered as invalid.
+	if !block.VerifyTimestamp(parent.medianTime(), uint64(time.Now().Unix())) {
+		return fmt.Errorf("mempool.blockTree.add: Invalid timestamp of block %x", hash)
+	}
+
+	if err := tree.chain.StoreBlock(block); err != nil {
+		return err
+	}
+	node := &treeNode{
+		hash:       hash,
+		header:     block.GetHeader(),
+		parent:     parent,
+		height:     height,
+		difficulty: difficulty,
+		work:       new(big.Int).Add(parent.work, pri.BlockWork(difficulty)),
+	}
+	parent.children = append(parent.children, node)
+	tree.nodes[hash] = node
+	delete(tree.tips, parent)
+	tree.tips[node] = true
+	if node.work.Cmp(tree.best.work) > 0 {
+		tree.best = node
+	}
+	return nil
+}
+
+// The function checks that the headers form a chain building on a block
+// of the tree, with valid proofs of work, and returns the hashes of those
+// not in the tree yet, whose bodies are to be downloaded.
+func (tree *blockTree) checkHeaders(headers []*pri.BlockHeader) ([]pri.HashResult, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	parent, ok := tree.nodes[headers[0].GetPrevHash()]
+	if !ok {
+		return nil, fmt.Errorf("mempool.blockTree.checkHeaders: Headers do not build on a known block")
+	}
+	if tree.tooDeep(tree.fork(parent)) {
+		return nil, fmt.Errorf("mempool.blockTree.checkHeaders: Headers fork too far below the tip")
+	}
+
+	needed := []pri.HashResult{}
+	for _, header := range headers {
+		hash := pri.Hash(header)
+		if !header.VerifyPreviousHash(parent.hash) {
+			return nil, fmt.Errorf("mempool.blockTree.checkHeaders: Header %x does not link to the previous one", hash)
+		}
+		if tree.isInvalid(hash) {
+			return nil, fmt.Errorf("mempool.blockTree.checkHeaders: Block %x is invalid", hash)
+		}
+		if node, ok := tree.nodes[hash]; ok {
+			parent = node
+			continue
+		}
+
+		difficulty := parent.nextDifficulty()
+		if !header.VerifyDifficulty(int(parent.height+1), difficulty) {
+			return nil, fmt.Errorf("mempool.blockTree.checkHeaders: %w of header %x", ErrInvalidProofOfWork, hash)
+		}
+		if header.GetTimestamp() < parent.medianTime() {
+			return nil, fmt.Errorf("mempool.blockTree.checkHeaders: Invalid timestamp of header %x", hash)
+		}
+
+		// A node outside the tree, so that the next header is
+		// checked against it
+		parent = &treeNode{
+			hash:       hash,
+			header:     header,
+			parent:     parent,
+			height:     parent.height + 1,
+			difficulty: difficulty,
+			work:       new(big.Int).Add(parent.work, pri.BlockWork(difficulty)),
+		}
+		needed = append(needed, hash)
+	}
+	return needed, nil
+}
+
+// The function keeps the block until its parent arrives. Its difficulty
+// depends on the unknown parent, so its proof of work is checked against
+// the lowest difficulty a block can have one retarget after the tip, so
+// that the orphans cannot be filled for free. An honest block can fall
+// below it only while we are far behind, when sync fetches it anyway.
+func (tree *blockTree) addOrphan(hash pri.HashResult, block *pri.Block) error {
+	if !block.VerifyDifficulty(int(tree.best.height+1), tree.orphanDifficulty()) {
+		return fmt.Errorf("mempool.blockTree.addOrphan: Orphan block %x below the minimum proof of work", hash)
+	}
+	if len(tree.orphans) >= MAX_ORPHAN_BLOCKS {
+		for other := range tree.orphans {
+			tree.removeOrphan(other)
+			break
+		}
+	}
+	prev := block.GetHeader().GetPrevHash()
+	tree.orphans[hash] = block
+	tree.waiting[prev] = append(tree.waiting[prev], hash)
+	return nil
+}
+
+// The function returns the lowest difficulty required of an orphan.
+func (tree *blockTree) orphanDifficulty() uint32 {
+	difficulty := tree.best.nextDifficulty()
+	if pri.RETARGET_INTERVAL == 0 {
+		return difficulty
+	}
+	if difficulty <= pri.MAX_DIFFICULTY_STEP {
+		return 1
+	}
+	return difficulty - pri.MAX_DIFFICULTY_STEP
+}
+
+func (tree *blockTree) removeOrphan(hash pri.HashResult) {
+	block, ok := tree.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(tree.orphans, hash)
+
+	prev := block.GetHeader().GetPrevHash()
+	waiting := []pri.HashResult{}
+	for _, other := range tree.waiting[prev] {
+		if other != hash {
+			waiting = append(waiting, other)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(tree.waiting, prev)
+	} else {
+		tree.waiting[prev] = waiting
+	}
+}
+
+// The function finds the tip with the most work again, after the best
+// one has been removed.
+func (tree *blockTree) updateBest() {
+	tree.best = nil
+	for node := range tree.tips {
+		if tree.best == nil || node.work.Cmp(tree.best.work) > 0 {
+			tree.best = node
+		}
+	}
+}
+
+// The function reorganizes the chain to the branch with the most work.
+// The chain only switches to it if it has strictly more work than the
+// active chain. If a block of the branch turns out to be invalid, it is dropped with
+// its descendants, and the next best branch is tried.
+func (tree *blockTree) activateBest() error {
+	for {
+		best := tree.best
+		if best.work.Cmp(tree.chain.GetTotalWork()) <= 0 {
+			return nil
+		}
+
+		branch := []*treeNode{}
+		fork := tree.fork(best)
+		for node := best; node != fork; node = node.parent {
+			branch = append([]*treeNode{node}, branch...)
+		}
+		blocks := make([]*pri.Block, 0, len(branch))
+		for _, node := range branch {
+			block, err := tree.chain.GetBlockByHash(node.hash)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+
+		invalid, err := tree.chain.reorg(fork.height+1, blocks)
+		if !errors.Is(err, errInvalidBlock) {
+			return err
+		}
+		tree.drop(branch[invalid])
+	}
+}
+
+// The function returns the blocks from the old tip back to the active
+// chain, i.e. the ones taken off the chain by a reorg, the oldest first.
+func (tree *blockTree) disconnectedSince(oldTip pri.HashResult) []pri.HashResult {
+	hashes := []pri.HashResult{}
+	for node := tree.nodes[oldTip]; node != nil && !tree.onChain(node); node = node.parent {
+		hashes = append([]pri.HashResult{node.hash}, hashes...)
+	}
+	return hashes
+}
+
+// The function removes the node and its descendants from the tree,
+// and remembers them as invalid.
+func (tree *blockTree) drop(node *treeNode) {
+	for _, removed := range tree.remove(node) {
+		tree.invalid[removed.hash] = removed.height
+	}
+}
+
+// The function removes the node and its descendants from the tree,
+// and returns them.
+func (tree *blockTree) remove(node *treeNode) []*treeNode {
+	parent := node.parent
+	children := []*treeNode{}
+	for _, child := range parent.children {
+		if child != node {
+			children = append(children, child)
+		}
+	}
+	parent.children = children
+	if len(children) == 0 {
+		tree.tips[parent] = true
+	}
+
+	removed := []*treeNode{node}
+	for i := 0; i < len(removed); i++ {
+		delete(tree.nodes, removed[i].hash)
+		delete(tree.tips, removed[i])
+		removed = append(removed, removed[i].children...)
+	}
+	if _, ok := tree.nodes[tree.best.hash]; !ok {
+		tree.updateBest()
+	}
+	return removed
+}
+
+// The function removes the side branches forking too far below the tip,
+// and forgets the invalid blocks that deep. Blocks building on them are
+// rejected as forking too deep, or wait as orphans.
+func (tree *blockTree) prune() {
+	for tip := range tree.tips {
+		fork := tree.fork(tip)
+		if fork != tip && tree.tooDeep(fork) {
+			branch := tip
+			for branch.parent != fork {
+				branch = branch.parent
+			}
+			tree.remove(branch)
+		}
+	}
+	for hash, height := range tree.invalid {
+		if height+MAX_FORK_DEPTH < tree.chain.Height() {
+			delete(tree.invalid, hash)
+		}
+	}
+}
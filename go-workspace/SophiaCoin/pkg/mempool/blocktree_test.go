@@ -0,0 +1,183 @@
+package mempool
+
+import (
+	"testing"
+
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+// The function mines n empty blocks on top of prev, starting at the
+// given height, without appending them anywhere.
+func mineBranch(key *crypto.PublicKey, prev pri.HashResult, height uint32, n int) []*pri.Block {
+	blocks := []*pri.Block{}
+	for i := 0; i < n; i++ {
+		// A random start, so that branches mined in the same second
+		// differ
+		block := pri.NewBlock(prev, height, key, 0)
+		block.RandomizeNonce()
+		for !block.VerifyDifficulty(int(height), pri.INITIAL_DIFFICULTY) {
+			block.RandomizeNonce()
+		}
+		blocks = append(blocks, block)
+		prev = pri.Hash(block)
+		height++
+	}
+	return blocks
+}
+
+func TestBlockTree(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestChain(t)
+	tree := newBlockTree(chain)
+	genesis := pri.Hash(pri.GetGenesisBlock())
+
+	active := mineBranch(key.GetPublicKey(), genesis, 1, 2)
+	for _, block := range active {
+		if status, err := tree.process(block); err != nil || status != BlockConnected {
+			t.Fatalf("process(active) = %v, %v", status, err)
+		}
+	}
+
+	// A competing branch with the same work stays a side branch
+	side := mineBranch(key.GetPublicKey(), genesis, 1, 3)
+	for _, block := range side[:2] {
+		if status, err := tree.process(block); err != nil || status != BlockSideBranch {
+			t.Fatalf("process(side) = %v, %v", status, err)
+		}
+	}
+	if chain.GetTipHash() != pri.Hash(active[1]) {
+		t.Fatal("switched to a branch with the same work")
+	}
+
+	// Blocks arriving before their parent wait as orphans, and take
+	// over the chain once they are connected
+	more := mineBranch(key.GetPublicKey(), pri.Hash(side[2]), 4, 2)
+	for _, block := range more {
+		if status, err := tree.process(block); err != nil || status != BlockOrphan {
+			t.Fatalf("process(orphan) = %v, %v", status, err)
+		}
+	}
+	if status, err := tree.process(side[2]); err != nil || status != BlockConnected {
+		t.Fatalf("process(parent) = %v, %v", status, err)
+	}
+	if chain.Height() != 5 || chain.GetTipHash() != pri.Hash(more[1]) {
+		t.Fatalf("chain at height %d, want the side branch at height 5", chain.Height())
+	}
+	if len(tree.orphans) != 0 || len(tree.waiting) != 0 {
+		t.Fatal("connected orphans are still waiting")
+	}
+
+	// An orphan without a proof of work is not kept
+	weak := pri.NewBlock(pri.HashResult{1}, 7, key.GetPublicKey(), 0)
+	for weak.VerifyDifficulty(7, 1) {
+		weak.RandomizeNonce()
+	}
+	if _, err := tree.process(weak); err == nil || len(tree.orphans) != 0 {
+		t.Fatal("kept an orphan without a proof of work")
+	}
+	if status, _ := tree.process(active[1]); status != BlockKnown {
+		t.Fatalf("process(stale) = %v, want BlockKnown", status)
+	}
+	if _, err := chain.GetBlockByHash(pri.Hash(active[1])); err != nil {
+		t.Fatalf("stale block lost: %v", err)
+	}
+}
+
+func TestPruneBlockTree(t *testing.T) {
+	defer func(depth uint32) { MAX_FORK_DEPTH = depth }(MAX_FORK_DEPTH)
+	MAX_FORK_DEPTH = 2
+
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestChain(t)
+	tree := newBlockTree(chain)
+	genesis := pri.Hash(pri.GetGenesisBlock())
+
+	active := mineBranch(key.GetPublicKey(), genesis, 1, 4)
+	side := mineBranch(key.GetPublicKey(), genesis, 1, 2)
+	if _, err := tree.process(active[0]); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := tree.process(side[0]); err != nil || status != BlockSideBranch {
+		t.Fatalf("process(side) = %v, %v", status, err)
+	}
+	tree.invalid[pri.HashResult{1}] = 1
+
+	for _, block := range active[1:] {
+		if status, err := tree.process(block); err != nil || status != BlockConnected {
+			t.Fatalf("process(active) = %v, %v", status, err)
+		}
+	}
+	if _, ok := tree.nodes[pri.Hash(side[0])]; ok {
+		t.Fatal("side branch forking below MAX_FORK_DEPTH is kept")
+	}
+	if len(tree.tips) != 1 || tree.best.hash != pri.Hash(active[3]) {
+		t.Fatalf("%d tips, want only the tip of the chain", len(tree.tips))
+	}
+	if len(tree.invalid) != 0 {
+		t.Fatal("invalid block below MAX_FORK_DEPTH is remembered")
+	}
+	if _, err := tree.process(side[1]); err != nil {
+		t.Fatalf("process(pruned child) = %v", err)
+	}
+	if _, err := tree.process(side[0]); err == nil {
+		t.Fatal("accepted a block forking below MAX_FORK_DEPTH")
+	}
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, target := NewMempool(t.TempDir()), NewMempool(t.TempDir())
+	defer source.Close()
+	defer target.Close()
+	for _, block := range mineBranch(key.GetPublicKey(), pri.Hash(pri.GetGenesisBlock()), 1, 5) {
+		if err := source.AppendBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last *pri.HashResult
+	for {
+		locator := target.GetLocator()
+		if last != nil {
+			locator = append([]pri.HashResult{*last}, locator...)
+		}
+		headers := source.FindHeaders(locator, pri.HashResult{}, 2)
+		if len(headers) == 0 {
+			break
+		}
+		if len(headers) == 2 {
+			swapped := []*pri.BlockHeader{headers[1], headers[0]}
+			if _, err := target.CheckHeaders(swapped); err == nil {
+				t.Fatal("CheckHeaders accepted headers out of order")
+			}
+		}
+
+		needed, err := target.CheckHeaders(headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hash := range needed {
+			if _, err := target.ProcessBlock(source.GetBlockByHash(hash)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash := pri.Hash(headers[len(headers)-1])
+		last = &hash
+	}
+
+	sourceHeight, sourceTip := source.GetLatestInfo()
+	targetHeight, targetTip := target.GetLatestInfo()
+	if targetHeight != sourceHeight || pri.Hash(targetTip) != pri.Hash(sourceTip) {
+		t.Fatalf("synced to height %d, want %d", targetHeight, sourceHeight)
+	}
+}
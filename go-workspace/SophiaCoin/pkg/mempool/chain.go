@@ -2,60 +2,548 @@ package mempool
 
 import (
 	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os-project/SophiaCoin/pkg/blockstore"
 	"os-project/SophiaCoin/pkg/crypto"
 	pri "os-project/SophiaCoin/pkg/primitives"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
+var errInvalidBlock = errors.New("mempool.Chain.AppendBlock: Invalid block")
+
+// The chain keeps the UTXO set, the transaction index and the undo data
+// in a database under dir (see chainstate.go). Only the headers of the
+// active chain are kept in memory, block bodies are read from the block
+// store in dir/blocks, which also keeps the blocks of stale branches.
 type Chain struct {
-	difficulty uint32
+	dir   string
+	db    *bolt.DB
+	store *blockstore.Store
 
-	blocks []*pri.Block
-	txs    map[pri.HashResult]*pri.Transaction
-	utxos  map[pri.HashResult][]bool
+	headers      []*pri.BlockHeader // headers[i] is the header of the block at height i
+	difficulties []uint32           // difficulties[i] is the difficulty of the block at height i
+	works        []*big.Int         // works[i] is the cumulative work of blocks[0..i]
 }
 
-func newChain(difficulty uint32) *Chain {
-	return &Chain{
-		difficulty: difficulty,
+// The function opens (or creates) the chain state in dir. If the database
+// is missing while the block store is not empty, the chain state is rebuilt
+// from the block store. A data dir written by an older version, with one
+// file per block, is moved into the block store.
+func openChain(dir string) (*Chain, error) {
+	store, err := blockstore.Open(filepath.Join(dir, "blocks"))
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, "chainstate.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	chain := &Chain{
+		dir:   dir,
+		db:    db,
+		store: store,
+	}
 
-		blocks: []*pri.Block{pri.GetGenesisBlock()},
-		txs:    map[pri.HashResult]*pri.Transaction{},
-		utxos:  map[pri.HashResult][]bool{},
+	genesis := pri.GetGenesisBlock()
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := createBuckets(tx); err != nil {
+			return err
+		}
+		if tx.Bucket(bucketHeaders).Get(heightKey(0)) != nil {
+			return nil
+		}
+		header, err := pri.Serialize(genesis.GetHeader())
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketHeaders).Put(heightKey(0), header)
+	})
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketHeaders).ForEach(func(k, v []byte) error {
+				header, err := pri.Deserialize(v)
+				if err != nil {
+					return err
+				}
+				header_, ok := header.(*pri.BlockHeader)
+				if !ok || len(chain.headers) != int(heightFromKey(k)) {
+					return errors.New("mempool.openChain: Corrupted headers")
+				}
+				chain.pushHeader(header_)
+				return nil
+			})
+		})
+	}
+	if err == nil && pri.Hash(chain.headers[0]) != pri.Hash(genesis) {
+		err = errors.New("mempool.openChain: Genesis block mismatch")
+	}
+	if err == nil {
+		if store.Empty() {
+			err = chain.importBlockFiles()
+		} else if chain.Height() == 0 {
+			err = chain.reindex()
+		}
 	}
+	if err != nil {
+		chain.Close()
+		return nil, err
+	}
+	return chain, nil
 }
 
-func (chain *Chain) AppendBlock(block *pri.Block) error {
-	if !chain.VerifyBlock(block, true) {
-		return errors.New("mempool.Chain.AppendBlock: Invalid block")
+// The function throws away the chain state in dir and
+// rebuilds it from the block store.
+func Reindex(dir string) error {
+	err := os.Remove(filepath.Join(dir, "chainstate.db"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	chain, err := openChain(dir)
+	if err != nil {
+		return err
+	}
+	return chain.Close()
+}
+
+func (chain *Chain) Close() error {
+	err := chain.db.Close()
+	if err_ := chain.store.Close(); err == nil {
+		err = err_
 	}
+	return err
+}
+
+// The function moves the blocks of an older data dir, stored as one file
+// per height in dir/blocks, into the block store. The blocks above the tip
+// are connected until a file is missing or a block does not fit the chain.
+func (chain *Chain) importBlockFiles() error {
+	return chain.update(func(tx *bolt.Tx) error {
+		for height := uint32(1); ; height++ {
+			data, err := os.ReadFile(chain.blockFile(height))
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			block, err := deserializeBlock(data)
+			if err != nil {
+				return nil
+			}
+			if height <= chain.Height() {
+				if pri.Hash(block) != pri.Hash(chain.headers[height]) {
+					return fmt.Errorf("mempool.Chain.importBlockFiles: Block %d does not match the chain", height)
+				}
+			} else if err := chain.connect(tx, block); errors.Is(err, errInvalidBlock) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := chain.saveBlock(tx, block); err != nil {
+				return err
+			}
+		}
+	})
+}
 
-	chain.blocks = append(chain.blocks, block)
-	for idx, tx := range block.GetTransactions() {
-		chain.txs[pri.Hash(&tx)] = &tx
-		chain.utxos[pri.Hash(&tx)] = make([]bool, len(tx.GetTxOuts()))
-		for i := range chain.utxos[pri.Hash(&tx)] {
-			chain.utxos[pri.Hash(&tx)][i] = true
+// The function rebuilds the chain state from the block store. Every stored
+// block is indexed by hash, and the branch with the most work whose blocks
+// are all valid becomes the active chain. The chain must be at genesis.
+func (chain *Chain) reindex() error {
+	locations := map[pri.HashResult]blockstore.Location{}
+	headers := map[pri.HashResult]*pri.BlockHeader{}
+	children := map[pri.HashResult][]pri.HashResult{}
+	err := chain.store.Scan(func(loc blockstore.Location, data []byte) error {
+		block, err := deserializeBlock(data)
+		if err != nil {
+			return nil
+		}
+		hash := pri.Hash(block)
+		if _, ok := headers[hash]; ok {
+			return nil
 		}
+		prev := block.GetHeader().GetPrevHash()
+		locations[hash] = loc
+		headers[hash] = block.GetHeader()
+		children[prev] = append(children[prev], hash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		if idx == 0 {
-			continue // coinbase transaction, doesn't need to check
+	// Connect the best branch, if one of its blocks turns out to be
+	// invalid, try again without it.
+	invalid := map[pri.HashResult]bool{}
+	for {
+		branch := bestBranch(headers, children, invalid)
+		err := chain.update(func(tx *bolt.Tx) error {
+			for hash, loc := range locations {
+				if err := putBlockLocation(tx, hash, loc); err != nil {
+					return err
+				}
+			}
+			for _, hash := range branch {
+				block, err := chain.readBlock(locations[hash])
+				if err != nil {
+					return err
+				}
+				err = chain.connect(tx, block)
+				if errors.Is(err, errInvalidBlock) {
+					invalid[hash] = true
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !errors.Is(err, errInvalidBlock) {
+			return err
 		}
-		for _, txIn := range tx.GetTxIns() {
-			if !chain.utxos[txIn.GetTxPtr()][txIn.GetIndex()] {
-				panic("mempool.Chain.AppendBlock: Invalid transaction")
+	}
+}
+
+// The function returns the hashes of the branch from the genesis block
+// with the most work. Only the headers are checked (the previous hash and
+// the difficulty), and the blocks known to be invalid are skipped.
+func bestBranch(
+	headers map[pri.HashResult]*pri.BlockHeader,
+	children map[pri.HashResult][]pri.HashResult,
+	invalid map[pri.HashResult]bool,
+) []pri.HashResult {
+	scratch := &Chain{}
+	scratch.pushHeader(pri.GetGenesisBlock().GetHeader())
+	path := []pri.HashResult{}
+	best := []pri.HashResult{}
+	bestWork := big.NewInt(0)
+
+	var visit func(hash pri.HashResult)
+	visit = func(hash pri.HashResult) {
+		for _, child := range children[hash] {
+			header := headers[child]
+			if invalid[child] || !header.VerifyDifficulty(len(scratch.headers), scratch.NextDifficulty()) {
+				continue
+			}
+			scratch.pushHeader(header)
+			path = append(path, child)
+			if scratch.GetTotalWork().Cmp(bestWork) > 0 {
+				bestWork = scratch.GetTotalWork()
+				best = append([]pri.HashResult{}, path...)
 			}
-			chain.utxos[txIn.GetTxPtr()][txIn.GetIndex()] = false
+			visit(child)
+			path = path[:len(path)-1]
+			scratch.popHeader()
 		}
 	}
+	visit(pri.Hash(scratch.headers[0]))
+	return best
+}
+
+// The function runs fn in a database transaction. If fn fails, both the
+// database and the in-memory headers are left unchanged.
+func (chain *Chain) update(fn func(tx *bolt.Tx) error) error {
+	headers, difficulties, works := chain.headers, chain.difficulties, chain.works
+	err := chain.db.Update(fn)
+	if err != nil {
+		chain.headers, chain.difficulties, chain.works = headers, difficulties, works
+	}
+	return err
+}
+
+func (chain *Chain) pushHeader(header *pri.BlockHeader) {
+	if len(chain.headers) == 0 {
+		chain.headers = []*pri.BlockHeader{header}
+		chain.difficulties = []uint32{0}
+		chain.works = []*big.Int{big.NewInt(0)}
+		return
+	}
+	difficulty := chain.NextDifficulty()
+	work := new(big.Int).Add(chain.works[len(chain.works)-1], pri.BlockWork(difficulty))
+	chain.difficulties = append(chain.difficulties, difficulty)
+	chain.works = append(chain.works, work)
+	chain.headers = append(chain.headers, header)
+}
+
+func (chain *Chain) popHeader() {
+	// Cap the slices so that a later push does not overwrite
+	// the arrays shared with a snapshot taken by update.
+	n := len(chain.headers) - 1
+	chain.headers = chain.headers[:n:n]
+	chain.difficulties = chain.difficulties[:n:n]
+	chain.works = chain.works[:n:n]
+}
+
+func (chain *Chain) Height() uint32 {
+	return uint32(len(chain.headers) - 1)
+}
+
+func (chain *Chain) GetHeader(height uint32) *pri.BlockHeader {
+	if height >= uint32(len(chain.headers)) {
+		return nil
+	}
+	return chain.headers[height]
+}
+
+func (chain *Chain) GetTipHash() pri.HashResult {
+	return pri.Hash(chain.headers[len(chain.headers)-1])
+}
+
+// The file of the block at the given height in a data dir written
+// by an older version.
+func (chain *Chain) blockFile(height uint32) string {
+	return filepath.Join(chain.dir, "blocks", fmt.Sprintf("Block%d.dat", height))
+}
+
+func deserializeBlock(data []byte) (*pri.Block, error) {
+	block, err := pri.Deserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	block_, ok := block.(*pri.Block)
+	if !ok {
+		return nil, errors.New("mempool.deserializeBlock: Not a block")
+	}
+	return block_, nil
+}
+
+func (chain *Chain) readBlock(loc blockstore.Location) (*pri.Block, error) {
+	data, err := chain.store.Read(loc)
+	if err != nil {
+		return nil, err
+	}
+	return deserializeBlock(data)
+}
+
+// The function appends the body of the block to the block store, unless it
+// is already there, and indexes it by hash within the database transaction.
+// The record is synced to disk before the transaction commits.
+func (chain *Chain) saveBlock(tx *bolt.Tx, block *pri.Block) error {
+	hash := pri.Hash(block)
+	if _, ok, err := getBlockLocation(tx, hash); err != nil || ok {
+		return err
+	}
+	data, err := pri.Serialize(block)
+	if err != nil {
+		return err
+	}
+	loc, err := chain.store.Append(data)
+	if err != nil {
+		return err
+	}
+	return putBlockLocation(tx, hash, loc)
+}
+
+// The function stores the body of a block that is not connected,
+// e.g. a block on a side branch, so that it can be read by hash.
+func (chain *Chain) StoreBlock(block *pri.Block) error {
+	return chain.db.Update(func(tx *bolt.Tx) error {
+		return chain.saveBlock(tx, block)
+	})
+}
+
+// The function reads the body of a stored block, whether it is
+// on the active chain or on a stale branch.
+func (chain *Chain) GetBlockByHash(hash pri.HashResult) (*pri.Block, error) {
+	genesis := pri.GetGenesisBlock()
+	if hash == pri.Hash(genesis) {
+		return genesis, nil
+	}
+
+	var loc blockstore.Location
+	var ok bool
+	err := chain.db.View(func(tx *bolt.Tx) error {
+		var err error
+		loc, ok, err = getBlockLocation(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("mempool.Chain.GetBlockByHash: Unknown block %x", hash)
+	}
+
+	block, err := chain.readBlock(loc)
+	if err != nil {
+		return nil, err
+	}
+	if pri.Hash(block) != hash {
+		return nil, fmt.Errorf("mempool.Chain.GetBlockByHash: Block %x is corrupted", hash)
+	}
+	return block, nil
+}
+
+// The function reads the body of the block at the given height
+// of the active chain.
+func (chain *Chain) GetBlock(height uint32) (*pri.Block, error) {
+	header := chain.GetHeader(height)
+	if header == nil {
+		return nil, fmt.Errorf("mempool.Chain.GetBlock: No block at height %d", height)
+	}
+	return chain.GetBlockByHash(pri.Hash(header))
+}
+
+// The function returns the difficulty that the block at the next height
+// must satisfy. Every node computes it from the timestamps of the blocks
+// on the chain, so it does not depend on any local setting.
+func (chain *Chain) NextDifficulty() uint32 {
+	height := uint32(len(chain.headers))
+	return nextDifficulty(height, chain.difficulties[height-1], func(h uint32) *pri.BlockHeader {
+		return chain.headers[h]
+	})
+}
+
+// The function returns the difficulty of a block at the given height,
+// given the difficulty of its parent and a function returning the
+// headers of its ancestors.
+func nextDifficulty(height uint32, last uint32, ancestor func(uint32) *pri.BlockHeader) uint32 {
+	if height == 1 {
+		return pri.INITIAL_DIFFICULTY
+	}
+	if pri.RETARGET_INTERVAL == 0 || height%pri.RETARGET_INTERVAL != 0 {
+		return last
+	}
+
+	first := height - pri.RETARGET_INTERVAL
+	if first == 0 {
+		first = 1 // the genesis timestamp is not a mining time
+	}
+	timespan := int64(ancestor(height-1).GetTimestamp()) -
+		int64(ancestor(first).GetTimestamp())
+	return pri.NextDifficulty(last, timespan, height-1-first)
+}
 
+// The function returns the cumulative proof-of-work of the chain,
+// which is used to pick the best chain among competing ones.
+func (chain *Chain) GetTotalWork() *big.Int {
+	return new(big.Int).Set(chain.works[len(chain.works)-1])
+}
+
+// The function returns the median timestamp of the last
+// MEDIAN_TIME_SPAN blocks on the chain.
+func (chain *Chain) medianTime() uint64 {
+	start := len(chain.headers) - pri.MEDIAN_TIME_SPAN
+	if start < 0 {
+		start = 0
+	}
+	timestamps := make([]uint64, 0, len(chain.headers)-start)
+	for _, header := range chain.headers[start:] {
+		timestamps = append(timestamps, header.GetTimestamp())
+	}
+	return median(timestamps)
+}
+
+func median(timestamps []uint64) uint64 {
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// The function verifies the block and connects it on top of the chain
+// within the database transaction.
+func (chain *Chain) connect(tx *bolt.Tx, block *pri.Block) error {
+	if !chain.verifyBlock(tx, block, true) {
+		return errInvalidBlock
+	}
+	if err := connectBlock(tx, block, chain.Height()+1); err != nil {
+		return err
+	}
+	chain.pushHeader(block.GetHeader())
+	return nil
+}
+
+func (chain *Chain) disconnect(tx *bolt.Tx) error {
+	if chain.Height() == 0 {
+		panic("mempool.Chain.RollbackBlock: Cannot rollback genesis block")
+	}
+	if err := disconnectBlock(tx, chain.Height()); err != nil {
+		return err
+	}
+	chain.popHeader()
 	return nil
 }
 
+func (chain *Chain) AppendBlock(block *pri.Block) error {
+	return chain.update(func(tx *bolt.Tx) error {
+		if err := chain.connect(tx, block); err != nil {
+			return err
+		}
+		// The body is on disk before the state referring to it is committed
+		return chain.saveBlock(tx, block)
+	})
+}
+
+func (chain *Chain) RollbackBlock() error {
+	return chain.update(chain.disconnect)
+}
+
+// The function rolls the chain back to height-1 and appends the blocks.
+// The new chain is kept only if all the blocks are valid and it has
+// strictly more work than the old one, otherwise nothing changes. The
+// blocks rolled back stay in the block store.
+func (chain *Chain) Reorg(height uint32, blocks []*pri.Block) error {
+	_, err := chain.reorg(height, blocks)
+	return err
+}
+
+// The function is Reorg, it also returns the index of the
+// invalid block if the error is errInvalidBlock, or -1.
+func (chain *Chain) reorg(height uint32, blocks []*pri.Block) (int, error) {
+	if height == 0 || height > chain.Height()+1 {
+		return -1, fmt.Errorf("mempool.Chain.Reorg: Invalid height")
+	}
+
+	invalid := -1
+	work := chain.GetTotalWork()
+	err := chain.update(func(tx *bolt.Tx) error {
+		for chain.Height() >= height {
+			if err := chain.disconnect(tx); err != nil {
+				return err
+			}
+		}
+		for i, block := range blocks {
+			err := chain.connect(tx, block)
+			if errors.Is(err, errInvalidBlock) {
+				invalid = i
+			}
+			if err != nil {
+				return err
+			}
+			if err := chain.saveBlock(tx, block); err != nil {
+				return err
+			}
+		}
+
+		// Only switch to a chain with strictly more work, a chain
+		// with the same work keeps the tip we have seen first.
+		if chain.GetTotalWork().Cmp(work) <= 0 {
+			return fmt.Errorf("mempool.Chain.Reorg: Not a chain with more work")
+		}
+		return nil
+	})
+	return invalid, err
+}
+
 // The function verify whether the new block can be
 // appended to the chain.
 func (chain *Chain) VerifyBlock(block *pri.Block, check_difficulty bool) bool {
+	ok := false
+	chain.db.View(func(tx *bolt.Tx) error {
+		ok = chain.verifyBlock(tx, block, check_difficulty)
+		return nil
+	})
+	return ok
+}
+
+func (chain *Chain) verifyBlock(tx *bolt.Tx, block *pri.Block, check_difficulty bool) bool {
 	// Check hash pointer in block header
-	if !block.VerifyPreviousHash(pri.Hash(chain.blocks[len(chain.blocks)-1])) {
+	if !block.VerifyPreviousHash(chain.GetTipHash()) {
 		return false
 	}
 
@@ -64,18 +552,27 @@ func (chain *Chain) VerifyBlock(block *pri.Block, check_difficulty bool) bool {
 		return false
 	}
 
+	if !block.VerifySize() {
+		return false
+	}
+
+	// Check timestamp
+	if !block.VerifyTimestamp(chain.medianTime(), uint64(time.Now().Unix())) {
+		return false
+	}
+
 	// Check difficulty
-	if check_difficulty && !block.VerifyDifficulty(len(chain.blocks), chain.difficulty) {
+	if check_difficulty && !block.VerifyDifficulty(len(chain.headers), chain.NextDifficulty()) {
 		return false
 	}
 
 	// Check non-coinbase transactions
-	ok, total_tips := chain.VerifyTransactions(block.GetTransactions()[1:])
+	ok, total_tips := chain.verifyTransactions(tx, block.GetTransactions()[1:], nil)
 	if !ok {
 		return false
 	}
 
-	if !block.VerifyCoinbase(uint32(len(chain.blocks)), total_tips) {
+	if !block.VerifyCoinbase(uint32(len(chain.headers)), total_tips) {
 		return false
 	}
 
@@ -87,26 +584,69 @@ func (chain *Chain) VerifyBlock(block *pri.Block, check_difficulty bool) bool {
 // uint64 indicating the total tips of the transactions(if the transactions
 // are valid).
 func (chain *Chain) VerifyTransactions(txs []pri.Transaction) (bool, uint64) {
-	// Check txIn outpoints, No double spending
-	// TODO: Check whether there are two transactions
-	//		 in the current block that spend the same
-	//		 outpoint.
+	return chain.VerifyPendingTransactions(txs, nil)
+}
+
+// The function is VerifyTransactions, where the transactions may also
+// spend the given outputs of transactions not on the chain yet.
+func (chain *Chain) VerifyPendingTransactions(txs []pri.Transaction, pending map[pri.TxIn]*pri.TxOut) (bool, uint64) {
+	var ok bool
+	var total_tips uint64
+	chain.db.View(func(tx *bolt.Tx) error {
+		ok, total_tips = chain.verifyTransactions(tx, txs, pending)
+		return nil
+	})
+	return ok, total_tips
+}
+
+func (chain *Chain) verifyTransactions(dbTx *bolt.Tx, txs []pri.Transaction, pending map[pri.TxIn]*pri.TxOut) (bool, uint64) {
+	// Check txIn outpoints, No double spending, neither against
+	// the chain nor between (or within) the given transactions.
+	// A transaction may spend the outputs of the ones before it.
+	spent := map[pri.TxIn]*utxoEntry{}
+	created := map[pri.TxIn]*utxoEntry{}
+	seen := map[pri.HashResult]bool{}
+	txindex := dbTx.Bucket(bucketTxIndex)
 	for _, tx := range txs {
 		txIns := tx.GetTxIns()
+		if len(txIns) == 0 {
+			return false, 0
+		}
 		for _, txIn := range txIns {
-			if _, ok := chain.utxos[txIn.GetTxPtr()]; !ok {
+			if _, ok := spent[txIn]; ok {
 				return false, 0
 			}
-			if len(chain.utxos[txIn.GetTxPtr()]) <= int(txIn.GetIndex()) {
-				return false, 0
+			entry, ok := created[txIn]
+			if !ok {
+				if txOut, ok := pending[txIn]; ok {
+					// Unconfirmed outputs are never created by a coinbase
+					entry = &utxoEntry{txOut: txOut, height: uint32(len(chain.headers))}
+				}
 			}
-			if !chain.utxos[txIn.GetTxPtr()][txIn.GetIndex()] {
-				return false, 0
+			if entry == nil {
+				var err error
+				entry, err = getUtxo(dbTx, txIn)
+				if err != nil || entry == nil {
+					return false, 0
+				}
 			}
+			spent[txIn] = entry
 		}
 
-		_, ok := chain.txs[pri.Hash(&tx)]
-		if ok {
+		hash := pri.Hash(&tx)
+		if txindex.Get(hash[:]) != nil || seen[hash] {
+			return false, 0
+		}
+		seen[hash] = true
+		for i, txOut := range tx.GetTxOuts() {
+			txOut := txOut
+			created[*pri.NewTxIn(hash, uint32(i))] = &utxoEntry{txOut: &txOut, height: uint32(len(chain.headers))}
+		}
+	}
+
+	// Coinbase outputs can only be spent after COINBASE_MATURITY blocks
+	for _, entry := range spent {
+		if !chain.isMature(entry) {
 			return false, 0
 		}
 	}
@@ -115,7 +655,11 @@ func (chain *Chain) VerifyTransactions(txs []pri.Transaction) (bool, uint64) {
 	for _, tx := range txs {
 		pubKeys := make([]*crypto.PublicKey, 0, len(tx.GetTxIns()))
 		for _, txIn := range tx.GetTxIns() {
-			pubKeys = append(pubKeys, chain.txs[txIn.GetTxPtr()].GetTxOuts()[txIn.GetIndex()].GetPubKey())
+			pubKey := spent[txIn].txOut.GetPubKey()
+			if pubKey == nil {
+				return false, 0
+			}
+			pubKeys = append(pubKeys, pubKey)
 		}
 
 		if !tx.VerifySignature(pubKeys) {
@@ -123,62 +667,80 @@ func (chain *Chain) VerifyTransactions(txs []pri.Transaction) (bool, uint64) {
 		}
 	}
 
-	// Check total outs equals total ins
+	// Check total outs does not exceed total ins
 	var total_tips uint64 = 0
 	for _, tx := range txs {
-		var tips int64 = 0
+		var total_in, total_out uint64 = 0, 0
 		txIns := tx.GetTxIns()
 		for _, txIn := range txIns {
-			tips += int64(chain.txs[txIn.GetTxPtr()].GetTxOuts()[txIn.GetIndex()].GetValue())
+			value := spent[txIn].txOut.GetValue()
+			if total_in+value < total_in {
+				return false, 0
+			}
+			total_in += value
 		}
 
 		txOuts := tx.GetTxOuts()
-		for _, txOuts := range txOuts {
-			tips -= int64(txOuts.GetValue())
+		for _, txOut := range txOuts {
+			if total_out+txOut.GetValue() < total_out {
+				return false, 0
+			}
+			total_out += txOut.GetValue()
 		}
 
-		if tips < 0 {
+		if total_out > total_in || total_tips+(total_in-total_out) < total_tips {
 			return false, 0
 		}
-		total_tips += uint64(tips)
+		total_tips += total_in - total_out
 	}
 
 	return true, total_tips
 }
 
-func (chain *Chain) RollbackBlock() error {
-	if len(chain.blocks) == 1 {
-		panic("mempool.Chain.RollbackBlock: Cannot rollback genesis block")
-	}
-	block := chain.blocks[len(chain.blocks)-1]
-	chain.blocks = chain.blocks[:len(chain.blocks)-1]
-	for i, tx := range block.GetTransactions() {
-		delete(chain.txs, pri.Hash(&tx))
-		delete(chain.utxos, pri.Hash(&tx))
-
-		if i == 0 {
-			continue // coinbase transaction, doesn't need to deal with txins
-		}
-		for _, txIn := range tx.GetTxIns() {
-			chain.utxos[txIn.GetTxPtr()][txIn.GetIndex()] = true
-		}
+// The function returns whether the output can be spent in the next
+// block, i.e. it is not created by a coinbase transaction or it has
+// at least COINBASE_MATURITY confirmations.
+func (chain *Chain) isMature(entry *utxoEntry) bool {
+	if !entry.coinbase {
+		return true
 	}
-
-	return nil
+	confirmations := uint32(len(chain.headers)) - entry.height
+	return confirmations >= pri.COINBASE_MATURITY
 }
 
-func (chain *Chain) Copy() *Chain {
-	newChain := newChain(chain.difficulty)
-	newChain.blocks = make([]*pri.Block, 0, len(chain.blocks))
-	newChain.blocks = append(newChain.blocks, chain.blocks...)
+// The function returns whether the transaction is on the chain.
+func (chain *Chain) HasTransaction(hash pri.HashResult) bool {
+	found := false
+	chain.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(bucketTxIndex).Get(hash[:]) != nil
+		return nil
+	})
+	return found
+}
 
-	for hash, tx := range chain.txs {
-		newChain.txs[hash] = tx
+// The function returns the output the txIn points to, whether
+// it is spent or not, by looking up the transaction index.
+func (chain *Chain) GetTxOut(txIn pri.TxIn) (*pri.TxOut, error) {
+	var location []byte
+	chain.db.View(func(tx *bolt.Tx) error {
+		ptr := txIn.GetTxPtr()
+		if v := tx.Bucket(bucketTxIndex).Get(ptr[:]); v != nil {
+			location = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if location == nil {
+		return nil, fmt.Errorf("mempool.Chain.GetTxOut: Unknown transaction %x", txIn.GetTxPtr())
 	}
 
-	for hash, utxo := range chain.utxos {
-		copy(newChain.utxos[hash], utxo)
+	height, idx := decodeTxLocation(location)
+	block, err := chain.GetBlock(height)
+	if err != nil {
+		return nil, err
 	}
-
-	return newChain
+	txs := block.GetTransactions()
+	if int(idx) >= len(txs) || int(txIn.GetIndex()) >= len(txs[idx].GetTxOuts()) {
+		return nil, fmt.Errorf("mempool.Chain.GetTxOut: Invalid outpoint")
+	}
+	return &txs[idx].GetTxOuts()[txIn.GetIndex()], nil
 }
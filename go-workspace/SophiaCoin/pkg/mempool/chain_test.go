@@ -0,0 +1,229 @@
+package mempool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+// The function mines a block paying the coinbase to the key on top of
+// the chain and appends it.
+func mineBlock(t *testing.T, chain *Chain, key *crypto.PublicKey, txs ...pri.Transaction) *pri.Block {
+	t.Helper()
+	ok, tips := chain.VerifyTransactions(txs)
+	if !ok {
+		t.Fatal("mineBlock: invalid transactions")
+	}
+	height := chain.Height() + 1
+	block := pri.NewBlock(chain.GetTipHash(), height, key, tips, txs...)
+	for !block.VerifyDifficulty(int(height), chain.NextDifficulty()) {
+		block.RandomizeNonce()
+	}
+	if err := chain.AppendBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func newTestChain(t *testing.T) *Chain {
+	t.Helper()
+	chain, err := openChain(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Close() })
+	return chain
+}
+
+func spendCoinbase(block *pri.Block, key *crypto.Key, to *crypto.PublicKey) pri.Transaction {
+	coinbase := block.GetTransactions()[0]
+	tx := pri.NewTx(
+		[]pri.TxIn{*pri.NewTxIn(pri.Hash(&coinbase), 0)},
+		[]pri.TxOut{*pri.NewTxOut(coinbase.GetTxOuts()[0].GetValue(), to)},
+		nil,
+	)
+	tx.Sign(key)
+	return *tx
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestChain(t)
+	first := mineBlock(t, chain, key.GetPublicKey())
+	tx := spendCoinbase(first, key, key.GetPublicKey())
+
+	for chain.Height() < pri.COINBASE_MATURITY {
+		if ok, _ := chain.VerifyTransactions([]pri.Transaction{tx}); ok {
+			t.Fatalf("coinbase spent with %d confirmations", chain.Height())
+		}
+		mineBlock(t, chain, key.GetPublicKey())
+	}
+
+	if ok, _ := chain.VerifyTransactions([]pri.Transaction{tx}); !ok {
+		t.Fatalf("mature coinbase rejected with %d confirmations", chain.Height())
+	}
+	mineBlock(t, chain, key.GetPublicKey(), tx)
+}
+
+func TestDoubleSpendInBlock(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestChain(t)
+	first := mineBlock(t, chain, key.GetPublicKey())
+	for chain.Height() < pri.COINBASE_MATURITY {
+		mineBlock(t, chain, key.GetPublicKey())
+	}
+
+	pay := spendCoinbase(first, key, key.GetPublicKey())
+	payOther := spendCoinbase(first, key, other.GetPublicKey())
+	coinbase := first.GetTransactions()[0]
+	outpoint := *pri.NewTxIn(pri.Hash(&coinbase), 0)
+	twice := pri.NewTx(
+		[]pri.TxIn{outpoint, outpoint},
+		[]pri.TxOut{*pri.NewTxOut(2*coinbase.GetTxOuts()[0].GetValue(), key.GetPublicKey())},
+		nil,
+	)
+	twice.Sign(key)
+
+	cases := []struct {
+		name string
+		txs  []pri.Transaction
+	}{
+		{"two transactions", []pri.Transaction{pay, payOther}},
+		{"same transaction twice", []pri.Transaction{pay, pay}},
+		{"same outpoint twice", []pri.Transaction{*twice}},
+	}
+	for _, c := range cases {
+		if ok, _ := chain.VerifyTransactions(c.txs); ok {
+			t.Errorf("%s: VerifyTransactions = true, want false", c.name)
+		}
+
+		height := chain.Height() + 1
+		block := pri.NewBlock(chain.GetTipHash(), height, key.GetPublicKey(), 0, c.txs...)
+		for !block.VerifyDifficulty(int(height), chain.NextDifficulty()) {
+			block.RandomizeNonce()
+		}
+		if err := chain.AppendBlock(block); err == nil {
+			t.Errorf("%s: AppendBlock accepted a double spend", c.name)
+		}
+	}
+}
+
+func TestChainStateOnDisk(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	chain, err := openChain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mineBlock(t, chain, key.GetPublicKey())
+	for chain.Height() < pri.COINBASE_MATURITY {
+		mineBlock(t, chain, key.GetPublicKey())
+	}
+	tx := spendCoinbase(first, key, key.GetPublicKey())
+	mineBlock(t, chain, key.GetPublicKey(), tx)
+	height, tip, work := chain.Height(), chain.GetTipHash(), chain.GetTotalWork()
+	chain.Close()
+
+	// Reopen the database, then rebuild it from the block files
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			if err := os.Remove(filepath.Join(dir, "chainstate.db")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		chain, err = openChain(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chain.Height() != height || chain.GetTipHash() != tip || chain.GetTotalWork().Cmp(work) != 0 {
+			t.Fatalf("rebuild=%v: reopened chain at height %d, want %d", rebuild, chain.Height(), height)
+		}
+		if ok, _ := chain.VerifyTransactions([]pri.Transaction{tx}); ok {
+			t.Fatalf("rebuild=%v: spent coinbase is spendable again", rebuild)
+		}
+		if _, err := chain.GetTxOut(tx.GetTxIns()[0]); err != nil {
+			t.Fatalf("rebuild=%v: spent output not indexed: %v", rebuild, err)
+		}
+		if rebuild {
+			break
+		}
+		chain.Close()
+	}
+	defer chain.Close()
+
+	if err := chain.RollbackBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := chain.VerifyTransactions([]pri.Transaction{tx}); !ok {
+		t.Fatal("rolled back spend is not spendable again")
+	}
+}
+
+func TestReorgKeepsStaleBlocks(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	chain, err := openChain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := []*pri.Block{mineBlock(t, chain, key.GetPublicKey()), mineBlock(t, chain, key.GetPublicKey())}
+
+	// A longer branch from the genesis block
+	branch := []*pri.Block{}
+	prev := pri.Hash(pri.GetGenesisBlock())
+	for height := uint32(1); height <= 3; height++ {
+		block := pri.NewBlock(prev, height, key.GetPublicKey(), 0)
+		for !block.VerifyDifficulty(int(height), pri.INITIAL_DIFFICULTY) {
+			block.RandomizeNonce()
+		}
+		branch = append(branch, block)
+		prev = pri.Hash(block)
+	}
+	if err := chain.Reorg(1, branch); err != nil {
+		t.Fatal(err)
+	}
+	if chain.GetTipHash() != prev {
+		t.Fatal("reorg did not switch to the longer branch")
+	}
+	for _, block := range stale {
+		if _, err := chain.GetBlockByHash(pri.Hash(block)); err != nil {
+			t.Fatalf("stale block lost after reorg: %v", err)
+		}
+	}
+	chain.Close()
+
+	// Reindexing picks the branch with the most work again
+	if err := Reindex(dir); err != nil {
+		t.Fatal(err)
+	}
+	chain, err = openChain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Close()
+	if chain.Height() != 3 || chain.GetTipHash() != prev {
+		t.Fatalf("reindexed chain at height %d, want the branch at height 3", chain.Height())
+	}
+	if _, err := chain.GetBlockByHash(pri.Hash(stale[1])); err != nil {
+		t.Fatalf("stale block not indexed after reindex: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package mempool
+
+// This file defines the on-disk layout of the chain state: the headers
+// of the active chain, the UTXO set, the transaction index, the undo
+// data of every block and the location of every stored block body. All
+// of them live in one bbolt database, so a block is connected or
+// disconnected in a single atomic transaction.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os-project/SophiaCoin/pkg/blockstore"
+	pri "os-project/SophiaCoin/pkg/primitives"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketHeaders = []byte("headers") // height -> block header
+	bucketUtxos   = []byte("utxos")   // outpoint -> utxoEntry
+	bucketTxIndex = []byte("txindex") // tx hash -> height, index in block
+	bucketUndo    = []byte("undo")    // height -> blockUndo
+	bucketBlocks  = []byte("blocks")  // block hash -> location in the block store
+)
+
+// Keys are big endian so that bbolt iterates them in height order.
+func heightKey(height uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, height)
+	return key
+}
+
+func heightFromKey(key []byte) uint32 {
+	return binary.BigEndian.Uint32(key)
+}
+
+func outpointKey(txIn pri.TxIn) []byte {
+	ptr := txIn.GetTxPtr()
+	key := make([]byte, 0, len(ptr)+4)
+	key = append(key, ptr[:]...)
+	return binary.BigEndian.AppendUint32(key, txIn.GetIndex())
+}
+
+func outpointFromKey(key []byte) pri.TxIn {
+	return *pri.NewTxIn(pri.HashResult(key[:32]), binary.BigEndian.Uint32(key[32:]))
+}
+
+// The transaction index maps a tx hash to the height of its
+// block and its index in the block.
+func encodeTxLocation(height uint32, idx uint32) []byte {
+	return binary.LittleEndian.AppendUint32(heightKey(height), idx)
+}
+
+func decodeTxLocation(location []byte) (uint32, uint32) {
+	return heightFromKey(location[:4]), binary.LittleEndian.Uint32(location[4:])
+}
+
+// An unspent output, together with the height of the block containing
+// it and whether it is created by a coinbase transaction.
+type utxoEntry struct {
+	txOut    *pri.TxOut
+	height   uint32
+	coinbase bool
+}
+
+func (e *utxoEntry) serialize() []byte {
+	txOut, err := pri.Serialize(e.txOut)
+	if err != nil {
+		panic(err)
+	}
+	result := binary.LittleEndian.AppendUint32(nil, e.height)
+	if e.coinbase {
+		result = append(result, 1)
+	} else {
+		result = append(result, 0)
+	}
+	return append(result, txOut...)
+}
+
+func deserializeUtxoEntry(data []byte) (*utxoEntry, error) {
+	if len(data) < 5 {
+		return nil, errors.New("mempool.deserializeUtxoEntry: Invalid data length")
+	}
+	txOut, err := pri.Deserialize(data[5:])
+	if err != nil {
+		return nil, err
+	}
+	txOut_, ok := txOut.(*pri.TxOut)
+	if !ok {
+		return nil, errors.New("mempool.deserializeUtxoEntry: Not a txOut")
+	}
+	return &utxoEntry{
+		txOut:    txOut_,
+		height:   binary.LittleEndian.Uint32(data[:4]),
+		coinbase: data[4] == 1,
+	}, nil
+}
+
+// Everything needed to disconnect a block without its body: the
+// transactions it created (and how many outputs each has), and the
+// outputs it spent.
+type blockUndo struct {
+	created []pri.HashResult
+	outputs []uint32
+	spent   []pri.TxIn
+	entries []*utxoEntry
+}
+
+func (u *blockUndo) serialize() []byte {
+	result := binary.LittleEndian.AppendUint32(nil, uint32(len(u.created)))
+	for i, hash := range u.created {
+		result = append(result, hash[:]...)
+		result = binary.LittleEndian.AppendUint32(result, u.outputs[i])
+	}
+	result = binary.LittleEndian.AppendUint32(result, uint32(len(u.spent)))
+	for i, txIn := range u.spent {
+		entry := u.entries[i].serialize()
+		result = append(result, outpointKey(txIn)...)
+		result = binary.LittleEndian.AppendUint32(result, uint32(len(entry)))
+		result = append(result, entry...)
+	}
+	return result
+}
+
+func deserializeBlockUndo(data []byte) (*blockUndo, error) {
+	r := bytes.NewReader(data)
+	u := &blockUndo{}
+
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < n; i++ {
+		var hash pri.HashResult
+		var outputs uint32
+		if _, err := io.ReadFull(r, hash[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &outputs); err != nil {
+			return nil, err
+		}
+		u.created = append(u.created, hash)
+		u.outputs = append(u.outputs, outputs)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < n; i++ {
+		key := make([]byte, 36)
+		var length uint32
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+			return nil, err
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		entry, err := deserializeUtxoEntry(data)
+		if err != nil {
+			return nil, err
+		}
+		u.spent = append(u.spent, outpointFromKey(key))
+		u.entries = append(u.entries, entry)
+	}
+	return u, nil
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{bucketHeaders, bucketUtxos, bucketTxIndex, bucketUndo, bucketBlocks} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getUtxo(tx *bolt.Tx, txIn pri.TxIn) (*utxoEntry, error) {
+	data := tx.Bucket(bucketUtxos).Get(outpointKey(txIn))
+	if data == nil {
+		return nil, nil
+	}
+	return deserializeUtxoEntry(data)
+}
+
+// The function returns where the body of the block is stored,
+// or false if it is not stored.
+func getBlockLocation(tx *bolt.Tx, hash pri.HashResult) (blockstore.Location, bool, error) {
+	data := tx.Bucket(bucketBlocks).Get(hash[:])
+	if data == nil {
+		return blockstore.Location{}, false, nil
+	}
+	loc, err := blockstore.DeserializeLocation(data)
+	return loc, err == nil, err
+}
+
+func putBlockLocation(tx *bolt.Tx, hash pri.HashResult, loc blockstore.Location) error {
+	return tx.Bucket(bucketBlocks).Put(hash[:], loc.Serialize())
+}
+
+// The function applies the block at the given height to the UTXO set and
+// the transaction index, and stores its header and undo data. The block
+// must have been verified.
+func connectBlock(tx *bolt.Tx, block *pri.Block, height uint32) error {
+	utxos := tx.Bucket(bucketUtxos)
+	txindex := tx.Bucket(bucketTxIndex)
+	undo := &blockUndo{}
+	inBlock := map[pri.HashResult]bool{}
+
+	for idx, t := range block.GetTransactions() {
+		hash := pri.Hash(&t)
+		if idx != 0 {
+			for _, txIn := range t.GetTxIns() {
+				entry, err := getUtxo(tx, txIn)
+				if err != nil {
+					return err
+				}
+				if entry == nil {
+					return fmt.Errorf("mempool.connectBlock: Missing outpoint %x:%d", txIn.GetTxPtr(), txIn.GetIndex())
+				}
+				// An output created and spent in the same block
+				// is not restored when the block is disconnected
+				if !inBlock[txIn.GetTxPtr()] {
+					undo.spent = append(undo.spent, txIn)
+					undo.entries = append(undo.entries, entry)
+				}
+				if err := utxos.Delete(outpointKey(txIn)); err != nil {
+					return err
+				}
+			}
+		}
+		inBlock[hash] = true
+
+		for i, txOut := range t.GetTxOuts() {
+			txOut := txOut
+			entry := &utxoEntry{txOut: &txOut, height: height, coinbase: idx == 0}
+			if err := utxos.Put(outpointKey(*pri.NewTxIn(hash, uint32(i))), entry.serialize()); err != nil {
+				return err
+			}
+		}
+
+		if err := txindex.Put(hash[:], encodeTxLocation(height, uint32(idx))); err != nil {
+			return err
+		}
+		undo.created = append(undo.created, hash)
+		undo.outputs = append(undo.outputs, uint32(len(t.GetTxOuts())))
+	}
+
+	if err := tx.Bucket(bucketUndo).Put(heightKey(height), undo.serialize()); err != nil {
+		return err
+	}
+	header, err := pri.Serialize(block.GetHeader())
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketHeaders).Put(heightKey(height), header)
+}
+
+// The function reverts connectBlock for the block at the given height,
+// using only the undo data.
+func disconnectBlock(tx *bolt.Tx, height uint32) error {
+	data := tx.Bucket(bucketUndo).Get(heightKey(height))
+	if data == nil {
+		return fmt.Errorf("mempool.disconnectBlock: Missing undo data of block %d", height)
+	}
+	undo, err := deserializeBlockUndo(data)
+	if err != nil {
+		return err
+	}
+
+	utxos := tx.Bucket(bucketUtxos)
+	for i := len(undo.created) - 1; i >= 0; i-- {
+		hash := undo.created[i]
+		for j := uint32(0); j < undo.outputs[i]; j++ {
+			if err := utxos.Delete(outpointKey(*pri.NewTxIn(hash, j))); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(bucketTxIndex).Delete(hash[:]); err != nil {
+			return err
+		}
+	}
+	for i, txIn := range undo.spent {
+		if err := utxos.Put(outpointKey(txIn), undo.entries[i].serialize()); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Bucket(bucketUndo).Delete(heightKey(height)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketHeaders).Delete(heightKey(height))
+}
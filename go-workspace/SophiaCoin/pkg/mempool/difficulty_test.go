@@ -0,0 +1,65 @@
+package mempool
+
+import (
+	"testing"
+
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+// The function returns a chain of the given number of blocks, counting
+// the genesis block, mined every interval seconds at difficulty 10. The
+// blocks are not checked.
+func timedChain(t *testing.T, blocks uint32, interval uint64) *Chain {
+	t.Helper()
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestChain(t)
+	prev := pri.Hash(pri.GetGenesisBlock())
+	for height := uint32(1); height < blocks; height++ {
+		block := pri.NewBlock(prev, height, key.GetPublicKey(), 0)
+		block.GetHeader().SetTimestamp(1000 + uint64(height)*interval)
+		chain.headers = append(chain.headers, block.GetHeader())
+		chain.difficulties = append(chain.difficulties, 10)
+		prev = pri.Hash(block)
+	}
+	return chain
+}
+
+func TestNextDifficultyRetarget(t *testing.T) {
+	defer func(interval uint32, target uint64, step uint32) {
+		pri.RETARGET_INTERVAL, pri.TARGET_BLOCK_TIME, pri.MAX_DIFFICULTY_STEP = interval, target, step
+	}(pri.RETARGET_INTERVAL, pri.TARGET_BLOCK_TIME, pri.MAX_DIFFICULTY_STEP)
+	pri.RETARGET_INTERVAL, pri.TARGET_BLOCK_TIME, pri.MAX_DIFFICULTY_STEP = 16, 30, 2
+
+	cases := []struct {
+		name     string
+		height   uint32
+		interval uint64
+		next     uint32
+	}{
+		{"first block", 1, 30, pri.INITIAL_DIFFICULTY},
+		{"between retargets", 17, 1, 10},
+		{"on time", 16, 30, 10},
+		{"on time, second period", 32, 30, 10},
+		{"twice as fast", 32, 15, 11},
+		{"fast, clamped", 16, 1, 12},
+		{"twice as slow", 32, 60, 9},
+		{"slow, clamped", 32, 600, 8},
+	}
+	for _, c := range cases {
+		if got := timedChain(t, c.height, c.interval).NextDifficulty(); got != c.next {
+			t.Errorf("%s: NextDifficulty at height %d = %d, want %d", c.name, c.height, got, c.next)
+		}
+	}
+
+	// Without retargeting, as on regtest, the difficulty never changes
+	pri.RETARGET_INTERVAL = 0
+	for _, height := range []uint32{2, 16, 32} {
+		if got := timedChain(t, height, 1).NextDifficulty(); got != 10 {
+			t.Errorf("NextDifficulty at height %d without retargeting = %d, want 10", height, got)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package mempool
+
+import (
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"time"
+)
+
+// Events a subscriber can buffer before it is dropped as too slow.
+var SUBSCRIBER_BUFFER = 1024
+
+// A pending transaction, as shown to operators and subscribers.
+type TxInfo struct {
+	Tx      *pri.Transaction
+	Hash    pri.HashResult
+	Fee     uint64
+	Size    int
+	Added   time.Time
+	Depends []pri.HashResult // the pending transactions it spends outputs of
+}
+
+// The totals of the pending transactions.
+type MempoolInfo struct {
+	Count   int
+	Size    int // serialized size in bytes
+	Fees    uint64
+	MaxSize int
+}
+
+type TxEventType int
+
+const (
+	TxAdded TxEventType = iota
+	TxRemoved
+)
+
+// Why a transaction left the pool.
+type RemoveReason string
+
+const (
+	RemovedMined    RemoveReason = "mined"
+	RemovedConflict RemoveReason = "conflict" // no longer valid against the chain
+	RemovedReplaced RemoveReason = "replaced"
+	RemovedEvicted  RemoveReason = "evicted"
+	RemovedExpired  RemoveReason = "expired"
+)
+
+type TxEvent struct {
+	Type   TxEventType
+	Info   TxInfo
+	Reason RemoveReason // set if Type is TxRemoved
+}
+
+// You should hold the lock before calling this function.
+func (pool *Mempool) txInfo(entry *txEntry) TxInfo {
+	return TxInfo{
+		Tx:      entry.tx,
+		Hash:    entry.hash,
+		Fee:     entry.fee,
+		Size:    entry.size,
+		Added:   entry.added,
+		Depends: pool.parents(entry),
+	}
+}
+
+// The function returns the pending transactions, the highest fee rate first.
+func (pool *Mempool) GetPending() []TxInfo {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	infos := []TxInfo{}
+	for _, entry := range pool.sortedPending() {
+		infos = append(infos, pool.txInfo(entry))
+	}
+	return infos
+}
+
+// The function returns the pending transaction, or nil.
+func (pool *Mempool) GetPendingInfo(hash pri.HashResult) *TxInfo {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	entry, ok := pool.pendingTxs[hash]
+	if !ok {
+		return nil
+	}
+	info := pool.txInfo(entry)
+	return &info
+}
+
+func (pool *Mempool) GetMempoolInfo() MempoolInfo {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	info := MempoolInfo{
+		Count:   len(pool.pendingTxs),
+		Size:    pool.pendingSize,
+		MaxSize: MAX_MEMPOOL_SIZE,
+	}
+	for _, entry := range pool.pendingTxs {
+		info.Fees += entry.fee
+	}
+	return info
+}
+
+// The function returns a channel receiving an event whenever a transaction
+// enters or leaves the pool, and a function to stop the subscription. The
+// channel is closed if the subscriber falls SUBSCRIBER_BUFFER events behind.
+func (pool *Mempool) Subscribe() (<-chan TxEvent, func()) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	events := make(chan TxEvent, SUBSCRIBER_BUFFER)
+	pool.subscribers[events] = true
+	cancel := func() {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+
+		if pool.subscribers[events] {
+			delete(pool.subscribers, events)
+			close(events)
+		}
+	}
+	return events, cancel
+}
+
+// You should hold the writer lock before calling this function.
+func (pool *Mempool) notify(event TxEvent) {
+	for events := range pool.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(pool.subscribers, events)
+			close(events)
+		}
+	}
+}
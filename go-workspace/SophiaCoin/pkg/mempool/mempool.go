@@ -2,6 +2,7 @@ package mempool
 
 import (
 	"fmt"
+	"math/big"
 	"os"
 	"os-project/SophiaCoin/pkg/crypto"
 	pri "os-project/SophiaCoin/pkg/primitives"
@@ -11,21 +12,41 @@ import (
 )
 
 type Mempool struct {
-	dir  string
-	lock sync.RWMutex
+	dir      string
+	lock     sync.RWMutex
+	saveLock sync.Mutex // serializes Save
 
 	chain *Chain
+	tree  *blockTree
+
+	pendingTxs  map[pri.HashResult]*txEntry
+	pendingSize int                         // serialized size of the pending transactions
+	spends      map[pri.TxIn]pri.HashResult // outpoint -> pending tx spending it
+	outputs     map[pri.TxIn]*pri.TxOut     // outputs of the pending txs, spent or not
+	payoutKeys  []*crypto.PublicKey         // paid in turn by the coinbase, one per height
+	newBlock    *pri.Block
+	changed     chan struct{}         // closed when newBlock is replaced
+	subscribers map[chan TxEvent]bool // see Subscribe
+}
 
-	pendingTxs map[pri.HashResult]*pri.Transaction
-	publicKey  *crypto.PublicKey // TODO
-	newBlock   *pri.Block
+// A block to mine on top of the chain, with the height and the
+// difficulty it is mined at.
+type BlockTemplate struct {
+	Block      *pri.Block // a copy, which can be changed by the miner
+	Height     uint32
+	Difficulty uint32
+	Fees       uint64 // paid by the transactions of the block
+	MinTime    uint64 // the earliest timestamp the block can have
+
+	// Closed when the template is stale, because of a new tip
+	// or new transactions
+	Changed <-chan struct{}
 }
 
-func NewMempool(dir string, difficulty uint32) *Mempool {
-	os.MkdirAll(dir, 0755)
-	os.MkdirAll(filepath.Join(dir, "blocks"), 0755)
+// The function loads the key in dir/wallets/miner.key,
+// or creates it if it does not exist.
+func loadMinerKey(dir string) *crypto.PublicKey {
 	os.MkdirAll(filepath.Join(dir, "wallets"), 0755)
-	fmtfilename := filepath.Join(dir, "blocks", "Block%d.dat")
 
 	minerKey, err := crypto.LoadKey(filepath.Join(dir, "wallets", "miner.key"))
 	if os.IsNotExist(err) {
@@ -40,112 +61,204 @@ func NewMempool(dir string, difficulty uint32) *Mempool {
 	} else if err != nil {
 		panic(err)
 	}
+	return minerKey.GetPublicKey()
+}
+
+// The coinbase of the blocks built by the pool pays the payout keys in
+// turn. If no key is given, it pays the key in dir/wallets/miner.key,
+// which is created if needed. Otherwise no private key is kept in dir.
+// The pending transactions saved by Save are reloaded.
+func NewMempool(dir string, payoutKeys ...*crypto.PublicKey) *Mempool {
+	os.MkdirAll(dir, 0755)
+	if len(payoutKeys) == 0 {
+		payoutKeys = []*crypto.PublicKey{loadMinerKey(dir)}
+	}
+
+	chain, err := openChain(dir)
+	if err != nil {
+		panic(err)
+	}
 
 	pool := &Mempool{
 		dir: dir,
 
-		chain: newChain(difficulty),
+		chain: chain,
+		tree:  newBlockTree(chain),
 
-		publicKey:  minerKey.GetPublicKey(),
+		payoutKeys: payoutKeys,
 		newBlock:   nil,
-		pendingTxs: map[pri.HashResult]*pri.Transaction{},
+		changed:    make(chan struct{}),
+		pendingTxs: map[pri.HashResult]*txEntry{},
+		spends:     map[pri.TxIn]pri.HashResult{},
+		outputs:    map[pri.TxIn]*pri.TxOut{},
+
+		subscribers: map[chan TxEvent]bool{},
 	}
 
+	// The transactions pending when the pool was last saved
+	pool.load()
+	pool.constructNewBlock()
+
+	return pool
+}
+
+func (pool *Mempool) Close() error {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	for i := 1; ; i++ {
-		filename := fmt.Sprintf(fmtfilename, i)
-		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			break
-		}
-		data, err := os.ReadFile(filename)
-		if err != nil {
-			panic(err)
-		}
-		block, err := pri.Deserialize(data)
-		if err != nil {
-			break
-		}
-		_, is_block := block.(*pri.Block)
-		if !is_block {
-			break
-		}
-		err = pool.chain.AppendBlock(block.(*pri.Block))
-		if err != nil {
-			break
-		}
+	return pool.chain.Close()
+}
+
+// You should hold the lock before calling this function.
+func (pool *Mempool) payoutKey(height uint32) *crypto.PublicKey {
+	return pool.payoutKeys[height%uint32(len(pool.payoutKeys))]
+}
+
+// The function replaces the payout keys, starting with the next template.
+func (pool *Mempool) SetPayoutKeys(payoutKeys ...*crypto.PublicKey) error {
+	if len(payoutKeys) == 0 {
+		return fmt.Errorf("mempool.Mempool.SetPayoutKeys: No payout key")
 	}
 
-	pool.newBlock = pri.NewBlock(
-		pri.Hash(pool.chain.blocks[len(pool.chain.blocks)-1]),
-		uint32(len(pool.chain.blocks)),
-		pool.publicKey,
-		0,
-	)
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
 
-	return pool
+	pool.payoutKeys = payoutKeys
+	pool.constructNewBlock()
+	return nil
 }
 
-func (pool *Mempool) Mine() {
-	time.Sleep(3 * time.Second)
-
-	for {
-		pool.lock.RLock()
+func (pool *Mempool) GetPayoutKeys() []*crypto.PublicKey {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
 
-		if pool.newBlock == nil {
-			panic("mempool.Mempool.Mine: newBlock is nil")
-		}
+	return append([]*crypto.PublicKey{}, pool.payoutKeys...)
+}
 
-		if !pool.chain.VerifyBlock(pool.newBlock, false) {
-			panic("mempool.Mempool.Mine: Invalid block")
-		}
+// The function returns a template of the next block, made of the
+// pending transactions.
+func (pool *Mempool) GetBlockTemplate() *BlockTemplate {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
 
-		pool.newBlock.RandomizeNonce()
-		if pool.newBlock.VerifyDifficulty(len(pool.chain.blocks), pool.chain.difficulty) {
-			pool.lock.RUnlock()
-			break
-		}
+	height := pool.chain.Height() + 1
+	var fees uint64 = 0
+	for _, txOut := range pool.newBlock.GetTransactions()[0].GetTxOuts() {
+		fees += txOut.GetValue()
+	}
+	return &BlockTemplate{
+		Block:      pool.newBlock.Copy(),
+		Height:     height,
+		Difficulty: pool.chain.NextDifficulty(),
+		Fees:       fees - pri.BlockReward(height),
+		MinTime:    pool.chain.medianTime(),
+		Changed:    pool.changed,
+	}
+}
 
-		pool.lock.RUnlock()
+// The function mines the block being built right away and appends it
+// to the chain. It is meant for networks of trivial difficulty, where
+// blocks are generated on request.
+func (pool *Mempool) Generate() (*pri.Block, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
 
-		time.Sleep(6 * time.Second)
+	block := pool.newBlock
+	difficulty := pool.chain.NextDifficulty()
+	for !block.VerifyDifficulty(int(pool.chain.Height()+1), difficulty) {
+		block.RandomizeNonce()
 	}
+	status, err := pool.processBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	if status != BlockConnected {
+		return nil, fmt.Errorf("mempool.Mempool.Generate: Block does not extend the chain")
+	}
+	return block, nil
 }
 
+// The function adds a transaction to the pool. It must pay the minimum
+// relay fee, and is rejected if the pool is full of transactions of a
+// higher fee rate. A transaction conflicting with pending ones replaces
+// them if replace-by-fee is enabled, see checkReplacement.
 func (pool *Mempool) AddTransaction(tx *pri.Transaction) error {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	if _, ok := pool.pendingTxs[pri.Hash(tx)]; ok {
-		return fmt.Errorf("mempool.Mempool.AddTransaction: Transaction already exists")
+	if err := pool.acceptTransaction(tx, time.Now()); err != nil {
+		return err
 	}
+	pool.constructNewBlock()
+	return nil
+}
 
-	transactions := []pri.Transaction{*tx}
-	for _, tx := range pool.pendingTxs {
-		transactions = append(transactions, *tx)
+// The function is AddTransaction, without rebuilding the block being
+// mined, for a transaction first seen at the given time. You should
+// hold the writer lock before calling this function.
+func (pool *Mempool) acceptTransaction(tx *pri.Transaction, added time.Time) error {
+	hash := pri.Hash(tx)
+	if _, ok := pool.pendingTxs[hash]; ok {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Transaction already exists")
 	}
 
-	ok, total_tips := pool.chain.VerifyTransactions(transactions)
+	// The transaction is checked against the chain and the outputs of
+	// the pending transactions, whether they are spent or not. Spending
+	// the same output as a pending transaction is a conflict, which is
+	// only accepted as a replacement below.
+	ok, fee := pool.chain.VerifyPendingTransactions([]pri.Transaction{*tx}, pool.outputs)
 	if !ok {
 		return fmt.Errorf("mempool.Mempool.AddTransaction: Invalid transaction")
 	}
 
-	pool.pendingTxs[pri.Hash(tx)] = tx
-	pool.newBlock = pri.NewBlock(
-		pri.Hash(pool.chain.blocks[len(pool.chain.blocks)-1]),
-		uint32(len(pool.chain.blocks)),
-		pool.publicKey,
-		total_tips,
-		transactions...,
-	)
-
-	// TODO: shall use the following to replace the previous one
-	// pool.newBlock.AddTransaction(*tx)
+	entry := newTxEntry(tx, fee, added)
+	if err := pool.checkPolicy(entry); err != nil {
+		return err
+	}
+	direct, replaced := pool.conflicts(tx.GetTxIns())
+	if len(direct) > 0 {
+		if err := checkReplacement(entry, direct, replaced); err != nil {
+			return err
+		}
+	}
 
+	for _, other := range replaced {
+		pool.removePending(other.hash, RemovedReplaced)
+	}
+	pool.addPending(entry)
+	for _, evicted := range pool.trimPending() {
+		if evicted == hash {
+			pool.restoreReplaced(replaced)
+			pool.constructNewBlock()
+			return fmt.Errorf("mempool.Mempool.AddTransaction: Mempool full, fee rate too low")
+		}
+	}
 	return nil
 }
 
+// The function adds back the transactions a rejected replacement had
+// removed, unless the eviction that rejected it took their parents
+// as well. You should hold the writer lock before calling
+// this function.
+func (pool *Mempool) restoreReplaced(replaced []*txEntry) {
+	for restored := true; restored; {
+		restored = false
+		left := []*txEntry{}
+		for _, entry := range replaced {
+			ok, _ := pool.chain.VerifyPendingTransactions([]pri.Transaction{*entry.tx}, pool.outputs)
+			if ok {
+				pool.addPending(entry)
+				restored = true
+			} else {
+				left = append(left, entry)
+			}
+		}
+		replaced = left
+	}
+}
+
+// The function appends the block to the chain, or the block being
+// mined if block is nil.
 func (pool *Mempool) AppendBlock(block *pri.Block) error {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
@@ -154,70 +267,65 @@ func (pool *Mempool) AppendBlock(block *pri.Block) error {
 		block = pool.newBlock
 	}
 
-	err := pool.chain.AppendBlock(block)
+	status, err := pool.processBlock(block)
 	if err != nil {
 		return err
 	}
-
-	// save new block
-	pool.saveBlock(block, uint32(len(pool.chain.blocks)-1))
-
-	pool.constructNewBlock()
+	if status != BlockConnected {
+		return fmt.Errorf("mempool.Mempool.AppendBlock: Block does not extend the chain")
+	}
 	return nil
 }
 
-func (pool *Mempool) SwitchChain(blocks []*pri.Block, height uint32) error {
+// The function adds a block received from a peer to the block tree. The
+// block may extend the chain, cause a reorg, be kept on a side branch or
+// wait for its parent as an orphan.
+func (pool *Mempool) ProcessBlock(block *pri.Block) (BlockStatus, error) {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	if len(blocks)+int(height) <= len(pool.chain.blocks) {
-		return fmt.Errorf("mempool.Mempool.SwitchChain: Not a longer chain")
-	}
-
-	chain_ := pool.chain.Copy()
-	origin_height := uint32(len(chain_.blocks)) - 1
-	if height > origin_height+1 {
-		return fmt.Errorf("mempool.Mempool.SwitchChain: Invalid height")
-	}
+	return pool.processBlock(block)
+}
 
-	for i := height; i <= origin_height; i++ {
-		chain_.RollbackBlock()
+// You should hold the writer lock before calling this function.
+func (pool *Mempool) processBlock(block *pri.Block) (BlockStatus, error) {
+	tip := pool.chain.GetTipHash()
+	status, err := pool.tree.process(block)
+	if pool.chain.GetTipHash() != tip {
+		pool.readmitDisconnected(tip)
+		pool.constructNewBlock()
 	}
+	return status, err
+}
 
-	for _, block := range blocks {
-		err := chain_.AppendBlock(block)
+// The function puts the transactions of the blocks a reorg took off the
+// chain back into the pool, unless the new chain has them or they are no
+// longer valid. You should hold the writer lock before calling this function.
+func (pool *Mempool) readmitDisconnected(oldTip pri.HashResult) {
+	now := time.Now()
+	for _, hash := range pool.tree.disconnectedSince(oldTip) {
+		block, err := pool.chain.GetBlockByHash(hash)
 		if err != nil {
-			break
+			continue
+		}
+		for _, tx := range block.GetTransactions()[1:] {
+			tx := tx
+			pool.acceptTransaction(&tx, now)
 		}
 	}
-
-	if len(chain_.blocks) <= len(pool.chain.blocks) {
-		return fmt.Errorf("mempool.Mempool.SwitchChain: Not a longer chain")
-	}
-
-	pool.chain = chain_
-	// now save the new blocks
-	for i := height; i < uint32(len(pool.chain.blocks)); i++ {
-		pool.saveBlock(pool.chain.blocks[i], i)
-	}
-
-	pool.constructNewBlock()
-
-	return nil
 }
 
 // You should hold the writer lock before calling this function.
 func (pool *Mempool) constructNewBlock() {
-	for _, tx := range pool.pendingTxs {
-		ok, _ := pool.chain.VerifyTransactions([]pri.Transaction{*tx})
-		if !ok {
-			delete(pool.pendingTxs, pri.Hash(tx))
-		}
-	}
+	pool.expirePending(time.Now())
+	pool.revalidatePending()
 
+	// Fill the block with the pending transactions of the highest fee
+	// rate, parents before children. The ones left out for lack of
+	// room stay pending.
 	current_transactions := []pri.Transaction{}
-	for _, tx := range pool.pendingTxs {
-		current_transactions = append(current_transactions, *tx)
+	for _, entry := range pool.selectPending(pri.MAX_BLOCK_SIZE - pool.baseBlockSize()) {
+		current_transactions = append(current_transactions, *entry.tx)
 	}
 
 	ok, tips := pool.chain.VerifyTransactions(current_transactions)
@@ -225,110 +333,168 @@ func (pool *Mempool) constructNewBlock() {
 		panic("mempool.Mempool.constructNewBlock: Invalid transaction")
 	}
 	pool.newBlock = pri.NewBlock(
-		pri.Hash(pool.chain.blocks[len(pool.chain.blocks)-1]),
-		uint32(len(pool.chain.blocks)),
-		pool.publicKey,
+		pool.chain.GetTipHash(),
+		pool.chain.Height()+1,
+		pool.payoutKey(pool.chain.Height()+1),
 		tips,
 		current_transactions...,
 	)
+	close(pool.changed)
+	pool.changed = make(chan struct{})
 }
 
-func (pool *Mempool) saveBlock(block *pri.Block, height uint32) error {
-	filename := filepath.Join(pool.dir, "blocks", fmt.Sprintf("Block%d.dat", height))
-	bytes, err := pri.Serialize(block)
+func (pool *Mempool) GetLatestInfo() (uint32, *pri.Block) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	block, err := pool.chain.GetBlock(pool.chain.Height())
 	if err != nil {
 		panic(err)
 	}
-	err = os.WriteFile(filename, bytes, 0644)
-	return err
+	return pool.chain.Height(), block
 }
 
-func (pool *Mempool) GetLatestInfo() (uint32, *pri.Block) {
+func (pool *Mempool) GetTotalWork() *big.Int {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 
-	return uint32(len(pool.chain.blocks) - 1), pool.chain.blocks[len(pool.chain.blocks)-1]
+	return pool.chain.GetTotalWork()
 }
 
 func (pool *Mempool) GetBlock(height uint32) *pri.Block {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 
-	if height >= uint32(len(pool.chain.blocks)) {
+	block, err := pool.chain.GetBlock(height)
+	if err != nil {
 		return nil
 	}
 
-	return pool.chain.blocks[height]
+	return block
 }
 
 func (pool *Mempool) GetBlockHash(height uint32) pri.HashResult {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 
-	if height >= uint32(len(pool.chain.blocks)) {
+	header := pool.chain.GetHeader(height)
+	if header == nil {
 		return pri.DEFAULT_HASH_RESULT
 	}
 
-	return pri.Hash(pool.chain.blocks[height])
+	return pri.Hash(header)
 }
 
-func (pool *Mempool) GetTxAmount(ptr pri.TxIn) uint64 {
+// The function returns whether the transaction is pending or on the chain.
+func (pool *Mempool) HasTransaction(hash pri.HashResult) bool {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 
-	return pool.chain.txs[ptr.GetTxPtr()].GetTxOuts()[ptr.GetIndex()].GetValue()
+	if _, ok := pool.pendingTxs[hash]; ok {
+		return true
+	}
+	return pool.chain.HasTransaction(hash)
 }
 
-func (pool *Mempool) ConstructTransaction(send *crypto.PublicKey, recv *crypto.PublicKey, amount uint64, fee uint64) (*pri.Transaction, error) {
+// The function returns the pending transaction, or nil.
+func (pool *Mempool) GetTransaction(hash pri.HashResult) *pri.Transaction {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 
-	if send == nil || recv == nil {
-		return nil, fmt.Errorf("mempool.Mempool.ConstructTransaction: Invalid public key")
+	entry, ok := pool.pendingTxs[hash]
+	if !ok {
+		return nil
 	}
+	return entry.tx
+}
 
-	var unspent_amount uint64 = 0
-	var unspent_txs []pri.TxIn = []pri.TxIn{}
-	var tx_outs []pri.TxOut = []pri.TxOut{}
+// The function returns whether the block has been processed, as a block
+// of the tree, an orphan or an invalid block.
+func (pool *Mempool) HasBlock(hash pri.HashResult) bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
 
-	for key, tx := range pool.chain.txs {
-		unspent := pool.chain.utxos[key]
+	_, ok := pool.tree.nodes[hash]
+	_, orphan := pool.tree.orphans[hash]
+	return ok || orphan || pool.tree.isInvalid(hash)
+}
 
-		for i := 0; i < len(tx.GetTxOuts()); i++ {
-			if !unspent[i] {
-				continue
-			}
+// The function reads a block by hash, whether it is on the
+// chain or on a side branch. It returns nil if it is not stored.
+func (pool *Mempool) GetBlockByHash(hash pri.HashResult) *pri.Block {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
 
-			if tx.GetTxOuts()[i].GetPubKey().Equal(send) {
-				unspent_amount += tx.GetTxOuts()[i].GetValue()
-				unspent_txs = append(unspent_txs, *pri.NewTxIn(key, uint32(i)))
-			}
+	block, err := pool.chain.GetBlockByHash(hash)
+	if err != nil {
+		return nil
+	}
+	return block
+}
 
-			if unspent_amount >= amount+fee {
-				break
-			}
+// The function returns hashes of blocks on the chain, one per height near
+// the tip and exponentially sparser towards the genesis block, so that a
+// peer can find the last block we have in common.
+func (pool *Mempool) GetLocator() []pri.HashResult {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	locator := []pri.HashResult{}
+	step := 1
+	for height := int(pool.chain.Height()); height > 0; height -= step {
+		locator = append(locator, pri.Hash(pool.chain.GetHeader(uint32(height))))
+		if len(locator) >= 10 {
+			step *= 2
 		}
+	}
+	return append(locator, pri.Hash(pool.chain.GetHeader(0)))
+}
 
-		if unspent_amount >= amount+fee {
+// The function returns up to max headers of the chain following the first
+// block of the locator found on the chain (or the genesis block), ending
+// at the stop hash if it is found.
+func (pool *Mempool) FindHeaders(locator []pri.HashResult, stop pri.HashResult, max int) []*pri.BlockHeader {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	var start uint32 = 0
+	for _, hash := range locator {
+		if node, ok := pool.tree.nodes[hash]; ok && pool.tree.onChain(node) {
+			start = node.height
 			break
 		}
 	}
 
-	if unspent_amount < amount+fee {
-		return nil, fmt.Errorf("mempool.Mempool.ConstructTransaction: Insufficient balance")
+	headers := []*pri.BlockHeader{}
+	for height := start + 1; height <= pool.chain.Height() && len(headers) < max; height++ {
+		header := pool.chain.GetHeader(height)
+		headers = append(headers, header)
+		if pri.Hash(header) == stop {
+			break
+		}
 	}
+	return headers
+}
 
-	if unspent_amount > amount+fee {
-		change := unspent_amount - amount - fee
-		tx_outs = append(tx_outs, *pri.NewTxOut(change, send))
-	}
-	tx_outs = append(tx_outs, *pri.NewTxOut(amount, recv))
+// The function checks the headers received from a peer before their
+// bodies are downloaded, see blockTree.checkHeaders.
+func (pool *Mempool) CheckHeaders(headers []*pri.BlockHeader) ([]pri.HashResult, error) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
 
-	tx := pri.NewTx(
-		unspent_txs,
-		tx_outs,
-		nil,
-	)
+	return pool.tree.checkHeaders(headers)
+}
 
-	return tx, nil
+func (pool *Mempool) GetTxAmount(ptr pri.TxIn) (uint64, error) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	if txOut, ok := pool.outputs[ptr]; ok {
+		return txOut.GetValue(), nil
+	}
+	txOut, err := pool.chain.GetTxOut(ptr)
+	if err != nil {
+		return 0, err
+	}
+	return txOut.GetValue(), nil
 }
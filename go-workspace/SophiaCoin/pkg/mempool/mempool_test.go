@@ -0,0 +1,411 @@
+package mempool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+func TestPayoutKeys(t *testing.T) {
+	keys := []*crypto.PublicKey{}
+	for i := 0; i < 2; i++ {
+		key, err := crypto.NewKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key.GetPublicKey())
+	}
+	dir := t.TempDir()
+	pool := NewMempool(dir, keys...)
+	if _, err := os.Stat(filepath.Join(dir, "wallets")); !os.IsNotExist(err) {
+		t.Fatalf("created a key with payout keys given: %v", err)
+	}
+
+	// The keys are paid in turn
+	for height := uint32(1); height <= 4; height++ {
+		block, err := pool.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		coinbase := block.GetTransactions()[0]
+		if len(coinbase.RelatesTo(*keys[height%2], false)) == 0 {
+			t.Fatalf("block %d does not pay key %d", height, height%2)
+		}
+	}
+
+	if err := pool.SetPayoutKeys(); err == nil {
+		t.Fatal("SetPayoutKeys() accepted no key")
+	}
+	if err := pool.SetPayoutKeys(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	coinbase := pool.GetBlockTemplate().Block.GetTransactions()[0]
+	if len(coinbase.RelatesTo(*keys[0], false)) == 0 {
+		t.Fatal("the template does not pay the new key")
+	}
+}
+
+// The function returns a pool whose first n coinbase outputs pay
+// the key and are mature, with their outpoints.
+func fundedPool(t *testing.T, key *crypto.Key, n int) (*Mempool, []pri.TxIn) {
+	pool := NewMempool(t.TempDir(), key.GetPublicKey())
+	coins := []pri.TxIn{}
+	for i := 0; i < n+int(pri.COINBASE_MATURITY); i++ {
+		block, err := pool.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		coins = append(coins, *pri.NewTxIn(pri.Hash(&block.GetTransactions()[0]), 0))
+	}
+	return pool, coins[:n]
+}
+
+// The function returns a signed transaction spending a coinbase
+// output of fundedPool back to the key, paying the fee.
+func payFee(key *crypto.Key, coin pri.TxIn, fee uint64) *pri.Transaction {
+	value := pri.MINER_REWARD - fee
+	tx := pri.NewTx(
+		[]pri.TxIn{coin},
+		[]pri.TxOut{*pri.NewTxOut(value, key.GetPublicKey())},
+		nil,
+	)
+	tx.Sign(key)
+	return tx
+}
+
+// The function is payFee, for a transaction signaling it is replaceable.
+func payReplaceable(key *crypto.Key, coin pri.TxIn, fee uint64) *pri.Transaction {
+	tx := pri.NewTx(
+		[]pri.TxIn{coin},
+		[]pri.TxOut{*pri.NewTxOut(pri.MINER_REWARD-fee, key.GetPublicKey())},
+		nil,
+	)
+	tx.SetReplaceable()
+	tx.Sign(key)
+	return tx
+}
+
+// The function returns a signed transaction spending the first output
+// of a pending parent back to the key, paying the fee.
+func payChild(key *crypto.Key, parent *pri.Transaction, fee uint64) *pri.Transaction {
+	value := parent.GetTxOuts()[0].GetValue() - fee
+	tx := pri.NewTx(
+		[]pri.TxIn{*pri.NewTxIn(pri.Hash(parent), 0)},
+		[]pri.TxOut{*pri.NewTxOut(value, key.GetPublicKey())},
+		nil,
+	)
+	tx.Sign(key)
+	return tx
+}
+
+func addTransactions(t *testing.T, pool *Mempool, txs ...*pri.Transaction) {
+	t.Helper()
+	for _, tx := range txs {
+		if err := pool.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFeeRatePolicy(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, coins := fundedPool(t, key, 5)
+
+	if err := pool.AddTransaction(payFee(key, coins[0], 0)); err == nil {
+		t.Fatal("accepted a transaction below the minimum relay fee")
+	}
+
+	// Transactions of the same size, the block has room for two
+	txs := []*pri.Transaction{}
+	for i, fee := range []uint64{10, 30, 20} {
+		txs = append(txs, payFee(key, coins[i], fee))
+	}
+	defer func(size int) { pri.MAX_BLOCK_SIZE = size }(pri.MAX_BLOCK_SIZE)
+	pri.MAX_BLOCK_SIZE = pool.baseBlockSize() + txs[1].Size() + txs[2].Size()
+	for _, tx := range txs {
+		if err := pool.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block := pool.GetBlockTemplate().Block.GetTransactions()
+	if len(block) != 3 || pri.Hash(&block[1]) != pri.Hash(txs[1]) || pri.Hash(&block[2]) != pri.Hash(txs[2]) {
+		t.Fatal("the block does not hold the transactions of the highest fee rate")
+	}
+	if !pool.HasTransaction(pri.Hash(txs[0])) {
+		t.Fatal("a transaction left out of the block is not pending")
+	}
+
+	// A full pool evicts the lowest fee rate
+	defer func(size int) { MAX_MEMPOOL_SIZE = size }(MAX_MEMPOOL_SIZE)
+	MAX_MEMPOOL_SIZE = pool.pendingSize + 10 // signatures differ in size by a few bytes
+	if err := pool.AddTransaction(payFee(key, coins[3], 5)); err == nil {
+		t.Fatal("accepted a transaction of the lowest fee rate into a full pool")
+	}
+	if err := pool.AddTransaction(payFee(key, coins[4], 40)); err != nil {
+		t.Fatal(err)
+	}
+	if pool.HasTransaction(pri.Hash(txs[0])) {
+		t.Fatal("the lowest fee rate is not evicted")
+	}
+
+	defer func(expiry time.Duration) { MEMPOOL_EXPIRY = expiry }(MEMPOOL_EXPIRY)
+	MEMPOOL_EXPIRY = 0
+	if err := pool.SetPayoutKeys(key.GetPublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.GetBlockTemplate().Block.GetTransactions()) != 1 {
+		t.Fatal("expired transactions are still pending")
+	}
+}
+
+func TestChainedTransactions(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, coins := fundedPool(t, key, 3)
+
+	parent := payFee(key, coins[0], 10)
+	child := payChild(key, parent, 50)
+	if err := pool.AddTransaction(child); err == nil {
+		t.Fatal("accepted a transaction spending an unknown output")
+	}
+	addTransactions(t, pool, parent, child)
+
+	// The child pays a higher fee rate, but comes after its parent
+	block := pool.GetBlockTemplate().Block.GetTransactions()
+	if len(block) != 3 || pri.Hash(&block[1]) != pri.Hash(parent) || pri.Hash(&block[2]) != pri.Hash(child) {
+		t.Fatal("the parent does not come before the child")
+	}
+
+	// A block holding both connects and disconnects cleanly
+	if _, err := pool.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if !pool.HasTransaction(pri.Hash(child)) || pool.GetTransaction(pri.Hash(child)) != nil {
+		t.Fatal("the child is not mined")
+	}
+	if err := pool.chain.RollbackBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := pool.chain.VerifyTransactions([]pri.Transaction{*parent, *child}); !ok {
+		t.Fatal("the outputs spent by the block are not restored")
+	}
+
+	// Evicting a parent evicts its descendants
+	pool, coins = fundedPool(t, key, 3)
+	parent = payFee(key, coins[0], 10)
+	child = payChild(key, parent, 50)
+	addTransactions(t, pool, parent, payFee(key, coins[1], 20), child)
+	defer func(size int) { MAX_MEMPOOL_SIZE = size }(MAX_MEMPOOL_SIZE)
+	MAX_MEMPOOL_SIZE = pool.pendingSize + 10
+	if err := pool.AddTransaction(payFee(key, coins[2], 30)); err != nil {
+		t.Fatal(err)
+	}
+	if pool.HasTransaction(pri.Hash(parent)) || pool.HasTransaction(pri.Hash(child)) {
+		t.Fatal("the child is not evicted with its parent")
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, coins := fundedPool(t, key, 2)
+
+	original := payReplaceable(key, coins[0], 10)
+	child := payChild(key, original, 20)
+	addTransactions(t, pool, original, child, payFee(key, coins[1], 10))
+
+	defer func(rbf bool) { REPLACE_BY_FEE = rbf }(REPLACE_BY_FEE)
+	REPLACE_BY_FEE = false
+	if err := pool.AddTransaction(payFee(key, coins[0], 100)); err == nil {
+		t.Fatal("replaced a transaction with replace-by-fee disabled")
+	}
+
+	// Only transactions signaling it can be replaced
+	REPLACE_BY_FEE = true
+	if err := pool.AddTransaction(payFee(key, coins[1], 100)); err == nil {
+		t.Fatal("replaced a transaction not signaling it is replaceable")
+	}
+
+	// The replacement pays for the child it evicts as well
+	if err := pool.AddTransaction(payFee(key, coins[0], 25)); err == nil {
+		t.Fatal("replaced transactions paying more in all")
+	}
+	replacement := payFee(key, coins[0], 100)
+	if err := pool.AddTransaction(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if pool.HasTransaction(pri.Hash(original)) || pool.HasTransaction(pri.Hash(child)) {
+		t.Fatal("the replaced transactions are still pending")
+	}
+	if pool.GetTransaction(pri.Hash(replacement)) == nil {
+		t.Fatal("the replacement is not pending")
+	}
+}
+
+func TestRejectedReplacement(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, coins := fundedPool(t, key, 3)
+	defer func(rbf bool, size int) { REPLACE_BY_FEE, MAX_MEMPOOL_SIZE = rbf, size }(REPLACE_BY_FEE, MAX_MEMPOOL_SIZE)
+	REPLACE_BY_FEE = true
+
+	original := payReplaceable(key, coins[0], 10)
+	addTransactions(t, pool, original, payFee(key, coins[1], 500), payFee(key, coins[2], 500))
+
+	// A larger replacement overflows the pool, and is the first evicted
+	replacement := pri.NewTx(
+		[]pri.TxIn{coins[0]},
+		[]pri.TxOut{
+			*pri.NewTxOut(pri.MINER_REWARD-30-1, key.GetPublicKey()),
+			*pri.NewTxOut(1, key.GetPublicKey()),
+		},
+		nil,
+	)
+	replacement.Sign(key)
+	MAX_MEMPOOL_SIZE = pool.pendingSize + 10
+	if err := pool.AddTransaction(replacement); err == nil {
+		t.Fatal("accepted a replacement evicted at once")
+	}
+	if !pool.HasTransaction(pri.Hash(original)) || len(pool.pendingTxs) != 3 {
+		t.Fatal("the replaced transaction is not restored")
+	}
+}
+
+func TestMempoolPersistence(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, coins := fundedPool(t, key, 2)
+
+	parent := payFee(key, coins[0], 10)
+	child := payChild(key, parent, 50)
+	addTransactions(t, pool, parent, child)
+	// As the periodic save and the one at shutdown may do
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() { errs <- pool.Save() }()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool = NewMempool(pool.dir, key.GetPublicKey())
+	if pool.GetTransaction(pri.Hash(parent)) == nil || pool.GetTransaction(pri.Hash(child)) == nil {
+		t.Fatal("the pending transactions are not reloaded")
+	}
+
+	// A reorg puts the transactions of the old branch back
+	height, tip := pool.GetLatestInfo()
+	if _, err := pool.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if pool.GetTransaction(pri.Hash(parent)) != nil {
+		t.Fatal("the mined transactions are still pending")
+	}
+	for _, block := range mineBranch(key.GetPublicKey(), pri.Hash(tip), height+1, 2) {
+		if _, err := pool.ProcessBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pool.GetTransaction(pri.Hash(parent)) == nil || pool.GetTransaction(pri.Hash(child)) == nil {
+		t.Fatal("the transactions taken off the chain are not pending again")
+	}
+}
+
+func TestMempoolEvents(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, coins := fundedPool(t, key, 2)
+	events, cancel := pool.Subscribe()
+	defer cancel()
+
+	parent := payFee(key, coins[0], 10)
+	child := payChild(key, parent, 50)
+	original := payReplaceable(key, coins[1], 10)
+	for _, tx := range []*pri.Transaction{parent, child, original} {
+		if err := pool.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		if event := <-events; event.Type != TxAdded || event.Info.Hash != pri.Hash(tx) {
+			t.Fatal("no event for an added transaction")
+		}
+	}
+
+	pending := pool.GetPending()
+	if len(pending) != 3 || pending[0].Hash != pri.Hash(child) {
+		t.Fatal("the pending transactions are not listed by fee rate")
+	}
+	info := pool.GetPendingInfo(pri.Hash(child))
+	if info == nil || info.Fee != 50 || len(info.Depends) != 1 || info.Depends[0] != pri.Hash(parent) {
+		t.Fatal("wrong pending transaction info")
+	}
+	if totals := pool.GetMempoolInfo(); totals.Count != 3 || totals.Fees != 70 ||
+		totals.Size != parent.Size()+child.Size()+original.Size() {
+		t.Fatal("wrong mempool totals")
+	}
+
+	defer func(rbf bool) { REPLACE_BY_FEE = rbf }(REPLACE_BY_FEE)
+	REPLACE_BY_FEE = true
+	replacement := payFee(key, coins[1], 100)
+	if err := pool.AddTransaction(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Type != TxRemoved || event.Reason != RemovedReplaced ||
+		event.Info.Hash != pri.Hash(original) {
+		t.Fatal("no event for the replaced transaction")
+	}
+	<-events // the replacement is added
+
+	if _, err := pool.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if event := <-events; event.Type != TxRemoved || event.Reason != RemovedMined {
+			t.Fatal("no event for a mined transaction")
+		}
+	}
+	if len(pool.GetPending()) != 0 {
+		t.Fatal("the mined transactions are still listed")
+	}
+}
+
+func TestCorruptMempoolFile(t *testing.T) {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := fundedPool(t, key, 1)
+	if err := os.WriteFile(pool.mempoolFile(), []byte("[{\"tx\": \"AAAA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool = NewMempool(pool.dir, key.GetPublicKey())
+	defer pool.Close()
+	if _, err := os.Stat(pool.mempoolFile() + ".bad"); err != nil {
+		t.Fatal("the corrupt file is not moved aside")
+	}
+}
@@ -0,0 +1,383 @@
+package mempool
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"sort"
+	"time"
+)
+
+var (
+	// A transaction must pay at least MIN_RELAY_FEE per 1000 bytes
+	// of its serialized size to enter the pool.
+	MIN_RELAY_FEE = uint64(1)
+
+	// The total serialized size of the pending transactions is kept
+	// under MAX_MEMPOOL_SIZE bytes by evicting the ones of the lowest
+	// fee rate, and a transaction pending for longer than MEMPOOL_EXPIRY
+	// is dropped.
+	MAX_MEMPOOL_SIZE = 32 << 20
+	MEMPOOL_EXPIRY   = 72 * time.Hour
+
+	// A pending transaction can have at most MAX_ANCESTORS pending
+	// ancestors, i.e. transactions whose outputs it spends directly or not.
+	MAX_ANCESTORS = 25
+
+	// If REPLACE_BY_FEE is set, a transaction conflicting with pending ones
+	// that signal they are replaceable replaces them and their descendants,
+	// at most MAX_REPLACEMENTS in all, provided it pays a higher fee and fee
+	// rate. Otherwise it is rejected.
+	REPLACE_BY_FEE   = true
+	MAX_REPLACEMENTS = 100
+)
+
+// A pending transaction, with what the pool needs to order it.
+type txEntry struct {
+	tx    *pri.Transaction
+	hash  pri.HashResult
+	size  int
+	fee   uint64
+	added time.Time
+}
+
+func newTxEntry(tx *pri.Transaction, fee uint64, added time.Time) *txEntry {
+	return &txEntry{
+		tx:    tx,
+		hash:  pri.Hash(tx),
+		size:  tx.Size(),
+		fee:   fee,
+		added: added,
+	}
+}
+
+// The function returns whether the entry pays a strictly higher fee
+// per byte than other.
+func (entry *txEntry) higherFeeRate(other *txEntry) bool {
+	// fee / size > other.fee / other.size, without dividing
+	return entry.fee*uint64(other.size) > other.fee*uint64(entry.size)
+}
+
+// The function returns whether the entry pays a higher fee per byte than
+// other. Among the same fee rate, the older entry comes first.
+func (entry *txEntry) better(other *txEntry) bool {
+	if entry.higherFeeRate(other) || other.higherFeeRate(entry) {
+		return entry.higherFeeRate(other)
+	}
+	if !entry.added.Equal(other.added) {
+		return entry.added.Before(other.added)
+	}
+	return bytes.Compare(entry.hash[:], other.hash[:]) < 0
+}
+
+// The function returns the lowest fee a transaction of the given size
+// must pay to be relayed, rounded up.
+func minRelayFee(size int) uint64 {
+	return (MIN_RELAY_FEE*uint64(size) + 999) / 1000
+}
+
+// You should hold the writer lock before calling this function.
+func (pool *Mempool) addPending(entry *txEntry) {
+	pool.pendingTxs[entry.hash] = entry
+	pool.pendingSize += entry.size
+	for _, txIn := range entry.tx.GetTxIns() {
+		pool.spends[txIn] = entry.hash
+	}
+	for i, txOut := range entry.tx.GetTxOuts() {
+		txOut := txOut
+		pool.outputs[*pri.NewTxIn(entry.hash, uint32(i))] = &txOut
+	}
+	pool.notify(TxEvent{Type: TxAdded, Info: pool.txInfo(entry)})
+}
+
+// The function removes the transaction alone, e.g. once it is mined, its
+// children then spend outputs on the chain. You should hold the writer
+// lock before calling this function.
+func (pool *Mempool) removePending(hash pri.HashResult, reason RemoveReason) {
+	entry, ok := pool.pendingTxs[hash]
+	if !ok {
+		return
+	}
+	info := pool.txInfo(entry)
+	delete(pool.pendingTxs, hash)
+	pool.pendingSize -= entry.size
+	for _, txIn := range entry.tx.GetTxIns() {
+		if pool.spends[txIn] == hash {
+			delete(pool.spends, txIn)
+		}
+	}
+	for i := range entry.tx.GetTxOuts() {
+		delete(pool.outputs, *pri.NewTxIn(hash, uint32(i)))
+	}
+	pool.notify(TxEvent{Type: TxRemoved, Info: info, Reason: reason})
+}
+
+// The function removes the transaction together with its pending
+// descendants, which cannot be valid without it, and returns their
+// hashes. You should hold the writer lock before calling this function.
+func (pool *Mempool) removeWithDescendants(hash pri.HashResult, reason RemoveReason) []pri.HashResult {
+	if _, ok := pool.pendingTxs[hash]; !ok {
+		return nil
+	}
+	removed := []pri.HashResult{}
+	for _, child := range pool.children(hash) {
+		removed = append(removed, pool.removeWithDescendants(child, reason)...)
+	}
+	pool.removePending(hash, reason)
+	return append(removed, hash)
+}
+
+// The function returns the pending transactions whose outputs the entry
+// spends. You should hold the lock before calling this function.
+func (pool *Mempool) parents(entry *txEntry) []pri.HashResult {
+	parents := []pri.HashResult{}
+	seen := map[pri.HashResult]bool{}
+	for _, txIn := range entry.tx.GetTxIns() {
+		parent := txIn.GetTxPtr()
+		if _, ok := pool.pendingTxs[parent]; ok && !seen[parent] {
+			seen[parent] = true
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// The function returns the pending transactions spending outputs of the
+// transaction. You should hold the lock before calling this function.
+func (pool *Mempool) children(hash pri.HashResult) []pri.HashResult {
+	entry, ok := pool.pendingTxs[hash]
+	if !ok {
+		return nil
+	}
+	children := []pri.HashResult{}
+	seen := map[pri.HashResult]bool{}
+	for i := range entry.tx.GetTxOuts() {
+		child, ok := pool.spends[*pri.NewTxIn(hash, uint32(i))]
+		if ok && !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// The function returns the number of pending ancestors of the entry.
+// You should hold the lock before calling this function.
+func (pool *Mempool) countAncestors(entry *txEntry) int {
+	seen := map[pri.HashResult]bool{}
+	queue := pool.parents(entry)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		queue = append(queue, pool.parents(pool.pendingTxs[hash])...)
+	}
+	return len(seen)
+}
+
+// The function returns the pending transactions, the highest
+// fee rate first. You should hold the lock before calling this function.
+func (pool *Mempool) sortedPending() []*txEntry {
+	entries := make([]*txEntry, 0, len(pool.pendingTxs))
+	for _, entry := range pool.pendingTxs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].better(entries[j]) })
+	return entries
+}
+
+// The function evicts the pending transactions of the lowest fee rate,
+// with their descendants, until the pool fits in MAX_MEMPOOL_SIZE, and
+// returns their hashes. You should hold the writer lock before calling
+// this function.
+func (pool *Mempool) trimPending() []pri.HashResult {
+	if pool.pendingSize <= MAX_MEMPOOL_SIZE {
+		return nil
+	}
+	evicted := []pri.HashResult{}
+	entries := pool.sortedPending()
+	for i := len(entries) - 1; i >= 0 && pool.pendingSize > MAX_MEMPOOL_SIZE; i-- {
+		evicted = append(evicted, pool.removeWithDescendants(entries[i].hash, RemovedEvicted)...)
+	}
+	return evicted
+}
+
+// The function drops the transactions pending since before MEMPOOL_EXPIRY,
+// with their descendants. You should hold the writer lock before calling
+// this function.
+func (pool *Mempool) expirePending(now time.Time) {
+	for hash, entry := range pool.pendingTxs {
+		if now.Sub(entry.added) > MEMPOOL_EXPIRY {
+			pool.removeWithDescendants(hash, RemovedExpired)
+		}
+	}
+}
+
+// The function updates the pool after the chain has changed: the mined
+// transactions leave it, and the ones no longer valid are dropped with
+// their descendants. You should hold the writer lock before calling this
+// function.
+func (pool *Mempool) revalidatePending() {
+	for hash := range pool.pendingTxs {
+		if pool.chain.HasTransaction(hash) {
+			pool.removePending(hash, RemovedMined)
+		}
+	}
+	for _, entry := range pool.sortedPending() {
+		if _, ok := pool.pendingTxs[entry.hash]; !ok {
+			continue // dropped with an ancestor
+		}
+		ok, _ := pool.chain.VerifyPendingTransactions([]pri.Transaction{*entry.tx}, pool.outputs)
+		if !ok {
+			pool.removeWithDescendants(entry.hash, RemovedConflict)
+		}
+	}
+}
+
+// A max-heap of pending transactions by fee rate.
+type entryHeap []*txEntry
+
+func (h entryHeap) Len() int            { return len(h) }
+func (h entryHeap) Less(i, j int) bool  { return h[i].better(h[j]) }
+func (h entryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(*txEntry)) }
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// The function selects the pending transactions of the highest fee rate
+// fitting in room bytes. A transaction is only selected after its pending
+// parents, so the result can be put in a block in order. You should hold
+// the lock before calling this function.
+func (pool *Mempool) selectPending(room int) []*txEntry {
+	selected := []*txEntry{}
+	included := map[pri.HashResult]bool{}
+	ready := &entryHeap{}
+	for _, entry := range pool.pendingTxs {
+		if len(pool.parents(entry)) == 0 {
+			*ready = append(*ready, entry)
+		}
+	}
+	heap.Init(ready)
+
+	for ready.Len() > 0 {
+		entry := heap.Pop(ready).(*txEntry)
+		if entry.size > room {
+			continue // its descendants are left out as well
+		}
+		selected = append(selected, entry)
+		included[entry.hash] = true
+		room -= entry.size
+
+		for _, hash := range pool.children(entry.hash) {
+			child := pool.pendingTxs[hash]
+			isReady := true
+			for _, parent := range pool.parents(child) {
+				isReady = isReady && included[parent]
+			}
+			if isReady {
+				heap.Push(ready, child)
+			}
+		}
+	}
+	return selected
+}
+
+// The function checks a transaction against the pool policy before it is
+// added. You should hold the lock before calling this function.
+func (pool *Mempool) checkPolicy(entry *txEntry) error {
+	if pool.countAncestors(entry) > MAX_ANCESTORS {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Too many pending ancestors")
+	}
+	if min := minRelayFee(entry.size); entry.fee < min {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Fee %d below the minimum relay fee %d", entry.fee, min)
+	}
+	if pool.baseBlockSize()+entry.size > pri.MAX_BLOCK_SIZE || entry.size > MAX_MEMPOOL_SIZE {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Transaction too large")
+	}
+	return nil
+}
+
+// The function returns the size of the next block without transactions,
+// with room for an extra nonce. You should hold the lock before calling
+// this function.
+func (pool *Mempool) baseBlockSize() int {
+	height := pool.chain.Height() + 1
+	block := pri.NewBlock(pool.chain.GetTipHash(), height, pool.payoutKey(height), 0)
+	block.SetExtraNonce(0)
+	return block.Size()
+}
+
+// The function returns the pending transactions a transaction spending
+// the given outputs would replace: the ones spending them, and their
+// descendants. You should hold the lock before calling this function.
+func (pool *Mempool) conflicts(txIns []pri.TxIn) (direct []*txEntry, replaced []*txEntry) {
+	seen := map[pri.HashResult]bool{}
+	queue := []pri.HashResult{}
+	for _, txIn := range txIns {
+		if hash, ok := pool.spends[txIn]; ok && !seen[hash] {
+			seen[hash] = true
+			direct = append(direct, pool.pendingTxs[hash])
+			queue = append(queue, hash)
+		}
+	}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		replaced = append(replaced, pool.pendingTxs[hash])
+		for _, child := range pool.children(hash) {
+			if !seen[child] {
+				seen[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return direct, replaced
+}
+
+// The function checks whether the entry can replace the pending
+// transactions it conflicts with directly, and their descendants.
+func checkReplacement(entry *txEntry, direct []*txEntry, replaced []*txEntry) error {
+	if !REPLACE_BY_FEE {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Transaction conflicts with pending transaction %x", direct[0].hash)
+	}
+	for _, other := range direct {
+		if !other.tx.IsReplaceable() {
+			return fmt.Errorf("mempool.Mempool.AddTransaction: Pending transaction %x is not replaceable", other.hash)
+		}
+	}
+	if len(replaced) > MAX_REPLACEMENTS {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Replaces %d transactions, more than %d", len(replaced), MAX_REPLACEMENTS)
+	}
+
+	isReplaced := map[pri.HashResult]bool{}
+	var replacedFee uint64 = 0
+	for _, other := range replaced {
+		isReplaced[other.hash] = true
+		replacedFee += other.fee
+	}
+	for _, txIn := range entry.tx.GetTxIns() {
+		if isReplaced[txIn.GetTxPtr()] {
+			return fmt.Errorf("mempool.Mempool.AddTransaction: Spends an output of a transaction it replaces")
+		}
+	}
+
+	// The replacement pays for the transactions it evicts,
+	// and for its own relay on top of that
+	if entry.fee < replacedFee+minRelayFee(entry.size) {
+		return fmt.Errorf("mempool.Mempool.AddTransaction: Fee %d too low to replace transactions paying %d", entry.fee, replacedFee)
+	}
+	for _, other := range direct {
+		if !entry.higherFeeRate(other) {
+			return fmt.Errorf("mempool.Mempool.AddTransaction: Fee rate not higher than the one of pending transaction %x", other.hash)
+		}
+	}
+	return nil
+}
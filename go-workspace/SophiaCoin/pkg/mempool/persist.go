@@ -0,0 +1,108 @@
+package mempool
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"path/filepath"
+	"time"
+)
+
+// A pending transaction as saved in dir/mempool.json.
+type savedTx struct {
+	Tx    []byte    `json:"tx"`
+	Added time.Time `json:"added"`
+}
+
+func (pool *Mempool) mempoolFile() string {
+	return filepath.Join(pool.dir, "mempool.json")
+}
+
+// The function saves the pending transactions, parents before children,
+// so that they can be reloaded by NewMempool after a restart. Saves are
+// serialized, and the file is replaced at once by a synced copy.
+func (pool *Mempool) Save() error {
+	pool.saveLock.Lock()
+	defer pool.saveLock.Unlock()
+
+	data, err := pool.marshalPending()
+	if err != nil {
+		return err
+	}
+	path := pool.mempoolFile()
+	file, err := os.CreateTemp(pool.dir, "mempool.json.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // if not renamed
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (pool *Mempool) marshalPending() ([]byte, error) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	saved := []savedTx{}
+	for _, entry := range pool.selectPending(math.MaxInt) {
+		data, err := pri.Serialize(entry.tx)
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, savedTx{Tx: data, Added: entry.added})
+	}
+	return json.MarshalIndent(saved, "", "  ")
+}
+
+// The function adds the transactions saved by Save back to the pool.
+// The ones no longer valid against the chain, or expired meanwhile,
+// are dropped. The pending transactions are only a cache, so an
+// unreadable file is logged and moved aside to mempool.json.bad rather
+// than stopping the node. You should hold the writer lock before calling
+// this function.
+func (pool *Mempool) load() {
+	path := pool.mempoolFile()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to read %s: %v\n", path, err)
+		return
+	}
+
+	saved := []savedTx{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Corrupt %s, moved to %s.bad: %v\n", path, path, err)
+		if err := os.Rename(path, path+".bad"); err != nil {
+			log.Printf("Failed to move %s: %v\n", path, err)
+		}
+		return
+	}
+	dropped := 0
+	for _, s := range saved {
+		tx, err := pri.Deserialize(s.Tx)
+		tx_, ok := tx.(*pri.Transaction)
+		if err != nil || !ok {
+			dropped++
+			continue
+		}
+		if err := pool.acceptTransaction(tx_, s.Added); err != nil {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d of the %d saved pending transactions\n", dropped, len(saved))
+	}
+}
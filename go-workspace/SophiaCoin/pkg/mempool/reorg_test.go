@@ -0,0 +1,76 @@
+package mempool
+
+import (
+	"testing"
+	"time"
+
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+// The function mines n blocks on top of the genesis block, the block at
+// height h with timestamp base+h*interval, at the difficulty the
+// timestamps lead to.
+func mineTimedBranch(t *testing.T, key *crypto.PublicKey, n uint32, base uint64, interval uint64) []*pri.Block {
+	t.Helper()
+	chain := newTestChain(t)
+	blocks := []*pri.Block{}
+	prev := pri.Hash(pri.GetGenesisBlock())
+	for height := uint32(1); height <= n; height++ {
+		block := pri.NewBlock(prev, height, key, 0)
+		block.GetHeader().SetTimestamp(base + uint64(height)*interval)
+		difficulty := chain.NextDifficulty()
+		for !block.VerifyDifficulty(int(height), difficulty) {
+			block.RandomizeNonce()
+		}
+		if err := chain.AppendBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		prev = pri.Hash(block)
+	}
+	return blocks
+}
+
+func TestReorgByWork(t *testing.T) {
+	defer func(interval uint32, target uint64, step uint32) {
+		pri.RETARGET_INTERVAL, pri.TARGET_BLOCK_TIME, pri.MAX_DIFFICULTY_STEP = interval, target, step
+	}(pri.RETARGET_INTERVAL, pri.TARGET_BLOCK_TIME, pri.MAX_DIFFICULTY_STEP)
+	pri.RETARGET_INTERVAL, pri.TARGET_BLOCK_TIME, pri.MAX_DIFFICULTY_STEP = 2, 30, 1
+
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newTestChain(t)
+	base := uint64(time.Now().Unix()) - 1000
+
+	// Slow blocks, the difficulty drops at height 4
+	active := mineTimedBranch(t, key.GetPublicKey(), 5, base, 120)
+	if err := chain.Reorg(1, active); err != nil {
+		t.Fatal(err)
+	}
+	tip, work := chain.GetTipHash(), chain.GetTotalWork()
+
+	// A competing branch with the same work does not take over
+	equal := mineTimedBranch(t, key.GetPublicKey(), 5, base+1, 120)
+	if err := chain.Reorg(1, equal); err == nil {
+		t.Fatal("reorganized to a branch with the same work")
+	}
+	if chain.GetTipHash() != tip || chain.GetTotalWork().Cmp(work) != 0 {
+		t.Fatal("chain changed by a rejected reorg")
+	}
+
+	// Fast blocks, the difficulty rises at height 4: a shorter branch
+	// with more work wins
+	shorter := mineTimedBranch(t, key.GetPublicKey(), 4, base, 1)
+	if err := chain.Reorg(1, shorter); err != nil {
+		t.Fatal(err)
+	}
+	if chain.Height() != 4 || chain.GetTipHash() != pri.Hash(shorter[3]) {
+		t.Fatalf("chain at height %d, want the shorter branch at height 4", chain.Height())
+	}
+	if chain.GetTotalWork().Cmp(work) <= 0 {
+		t.Fatal("switched to a branch without more work")
+	}
+}
@@ -0,0 +1,211 @@
+package miner
+
+// The miner searches for a block meeting the difficulty with several
+// workers. Each worker tries every nonce of the header, then rolls the
+// extra nonce in the coinbase to get a new merkle root, and starts over.
+// The workers use different extra nonces, so they never try the same
+// header. Whenever the template of the pool is stale, because of a new
+// tip or new transactions, the workers start over on the new template.
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os-project/SophiaCoin/pkg/mempool"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	CHECK_INTERVAL     = uint32(1 << 12) // nonces tried between two checks for a stale template
+	HASH_RATE_INTERVAL = 5 * time.Second
+)
+
+// Where the miner gets the templates of the blocks to mine, and
+// where it sends the blocks it finds. Both functions are called
+// from several goroutines.
+type Backend interface {
+	GetBlockTemplate() (*mempool.BlockTemplate, error)
+	SubmitBlock(block *pri.Block) error
+}
+
+// The function is called with every block the miner finds,
+// once it has been added to the pool.
+type BlockFunc func(block *pri.Block)
+
+type poolBackend struct {
+	pool    *mempool.Mempool
+	onBlock BlockFunc
+}
+
+// The backend mines on the pool of this node.
+func NewPoolBackend(pool *mempool.Mempool, onBlock BlockFunc) Backend {
+	return &poolBackend{pool: pool, onBlock: onBlock}
+}
+
+func (b *poolBackend) GetBlockTemplate() (*mempool.BlockTemplate, error) {
+	return b.pool.GetBlockTemplate(), nil
+}
+
+func (b *poolBackend) SubmitBlock(block *pri.Block) error {
+	status, err := b.pool.ProcessBlock(block)
+	if err != nil {
+		return err
+	}
+	if status != mempool.BlockConnected {
+		return fmt.Errorf("miner.poolBackend.SubmitBlock: Block %x does not extend the chain", pri.Hash(block))
+	}
+	if b.onBlock != nil {
+		b.onBlock(block)
+	}
+	return nil
+}
+
+type Miner struct {
+	backend Backend
+
+	lock    sync.Mutex
+	workers int
+	stop    chan struct{} // nil when the miner is stopped
+	done    sync.WaitGroup
+
+	hashes   atomic.Uint64 // hashes computed since the last sample
+	hashRate atomic.Uint64 // hashes per second
+}
+
+func New(backend Backend) *Miner {
+	return &Miner{backend: backend}
+}
+
+// The function starts mining with the number of workers,
+// restarting the miner if it is running.
+func (m *Miner) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Stopped under the same lock, so that concurrent starts cannot
+	// both launch workers
+	m.stopWorkers()
+	m.workers = workers
+	m.stop = make(chan struct{})
+	m.hashes.Store(0)
+	m.hashRate.Store(0)
+	m.done.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go m.work(uint64(i), uint64(workers), m.stop)
+	}
+	go m.sample(m.stop)
+	log.Printf("Started mining with %d workers\n", workers)
+}
+
+// The function stops the miner and waits for its workers to return.
+func (m *Miner) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stopWorkers()
+}
+
+// You should hold the lock before calling this function.
+func (m *Miner) stopWorkers() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	m.done.Wait()
+	m.stop = nil
+	m.hashRate.Store(0)
+	log.Println("Stopped mining")
+}
+
+// The function returns whether the miner is running, and with how many workers.
+func (m *Miner) Running() (bool, int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.stop != nil, m.workers
+}
+
+// The function returns the hashes per second of all the workers,
+// averaged over the last HASH_RATE_INTERVAL.
+func (m *Miner) HashRate() uint64 {
+	return m.hashRate.Load()
+}
+
+func (m *Miner) sample(stop <-chan struct{}) {
+	defer m.done.Done()
+
+	ticker := time.NewTicker(HASH_RATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.hashRate.Store(m.hashes.Swap(0) / uint64(HASH_RATE_INTERVAL/time.Second))
+		}
+	}
+}
+
+// The worker tries the extra nonces first, first+step, first+2*step, ...
+func (m *Miner) work(first uint64, step uint64, stop <-chan struct{}) {
+	defer m.done.Done()
+
+	for {
+		template, err := m.backend.GetBlockTemplate()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		block, ok := m.search(template, first, step, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !ok {
+			continue // the template is stale
+		}
+
+		if err := m.backend.SubmitBlock(block); err != nil {
+			log.Printf("Mined block %x rejected: %v\n", pri.Hash(block), err)
+			continue
+		}
+		log.Printf("Mined block %x at height %d\n", pri.Hash(block), template.Height)
+	}
+}
+
+// The function searches for a block meeting the difficulty of the
+// template, and returns false if the template gets stale first.
+func (m *Miner) search(template *mempool.BlockTemplate, first uint64, step uint64, stop <-chan struct{}) (*pri.Block, bool) {
+	block := template.Block
+	header := block.GetHeader()
+	for extraNonce := first; ; extraNonce += step {
+		block.SetExtraNonce(extraNonce)
+		for nonce := uint64(0); nonce <= math.MaxUint32; nonce++ {
+			if uint32(nonce)%CHECK_INTERVAL == 0 && nonce > 0 {
+				m.hashes.Add(uint64(CHECK_INTERVAL))
+				select {
+				case <-stop:
+					return nil, false
+				case <-template.Changed:
+					return nil, false
+				default:
+				}
+			}
+			header.SetNonce(uint32(nonce))
+			if header.VerifyDifficulty(int(template.Height), template.Difficulty) {
+				return block, true
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package miner
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"os-project/SophiaCoin/pkg/mempool"
+	pri "os-project/SophiaCoin/pkg/primitives"
+)
+
+func TestMiner(t *testing.T) {
+	pool := mempool.NewMempool(t.TempDir())
+	defer pool.Close()
+
+	mined := make(chan *pri.Block, 16)
+	m := New(NewPoolBackend(pool, func(block *pri.Block) {
+		select {
+		case mined <- block:
+		default:
+		}
+	}))
+	m.Start(2)
+	for i := 0; i < 3; i++ {
+		select {
+		case block := <-mined:
+			if !block.VerifyMerkleRoot() {
+				t.Fatal("the extra nonce breaks the merkle root")
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("no block mined")
+		}
+	}
+	m.Stop()
+	if running, _ := m.Running(); running {
+		t.Fatal("the miner is still running")
+	}
+
+	height, _ := pool.GetLatestInfo()
+	if height < 3 {
+		t.Fatalf("unexpected height %d", height)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if after, _ := pool.GetLatestInfo(); after != height {
+		t.Fatal("the miner mines after being stopped")
+	}
+	// Concurrent starts leave a single set of workers, which Stop stops
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Start(1)
+		}()
+	}
+	wg.Wait()
+	m.Stop()
+	height, _ = pool.GetLatestInfo()
+	time.Sleep(100 * time.Millisecond)
+	if after, _ := pool.GetLatestInfo(); after != height {
+		t.Fatal("workers of concurrent starts are left running")
+	}
+}
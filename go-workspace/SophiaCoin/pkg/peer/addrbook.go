@@ -0,0 +1,225 @@
+package peer
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	MAX_ADDRESSES    = 1024 // addresses kept in the address book
+	MAX_ADDR_FAILURE = 10   // failures in a row before an address that never worked is forgotten
+)
+
+// What we know about an address, saved in the address book.
+type AddrInfo struct {
+	Addr        string    `json:"addr"`
+	Successes   int       `json:"successes"`
+	Failures    int       `json:"failures"` // failures since the last success
+	LastSuccess time.Time `json:"last_success"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+// The function ranks the address, the higher the better: addresses that
+// worked come first, then the untried ones, then the ones that failed.
+func (info *AddrInfo) score() float64 {
+	score := float64(info.Successes) / float64(1+info.Failures)
+	if info.Successes == 0 {
+		score = -float64(info.Failures)
+	}
+	return score
+}
+
+// The address book keeps the addresses of the peers we have heard of,
+// with their connection stats, in a JSON file. Every function of the
+// address book is safe to call from several goroutines.
+type AddrBook struct {
+	path  string
+	lock  sync.Mutex
+	addrs map[string]*AddrInfo
+}
+
+// The function loads the address book from path, or creates an
+// empty one if the file does not exist or is corrupt.
+func NewAddrBook(path string) (*AddrBook, error) {
+	book := &AddrBook{
+		path:  path,
+		addrs: map[string]*AddrInfo{},
+	}
+	infos := []*AddrInfo{}
+	ok, err := loadJSON(path, &infos)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return book, nil
+	}
+	for _, info := range infos {
+		book.addrs[info.Addr] = info
+	}
+	return book, nil
+}
+
+// You should hold the lock before calling this function.
+func (book *AddrBook) save() error {
+	infos := make([]*AddrInfo, 0, len(book.addrs))
+	for _, info := range book.addrs {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return saveJSON(book.path, infos)
+}
+
+// The function adds the addresses we have heard of. When the book is
+// full, the address with the worst score is forgotten.
+func (book *AddrBook) Add(addrs ...string) error {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	added := false
+	for _, addr := range addrs {
+		if _, ok := book.addrs[addr]; ok {
+			continue
+		}
+		if len(book.addrs) >= MAX_ADDRESSES {
+			var worst *AddrInfo
+			for _, info := range book.addrs {
+				if worst == nil || info.score() < worst.score() {
+					worst = info
+				}
+			}
+			if worst.Successes > 0 {
+				continue // do not forget an address that worked for one never tried
+			}
+			delete(book.addrs, worst.Addr)
+		}
+		book.addrs[addr] = &AddrInfo{Addr: addr}
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	return book.save()
+}
+
+// The function records a successful connection to the address.
+func (book *AddrBook) Good(addr string) error {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	info, ok := book.addrs[addr]
+	if !ok {
+		info = &AddrInfo{Addr: addr}
+		book.addrs[addr] = info
+	}
+	info.Successes++
+	info.Failures = 0
+	info.LastSuccess = time.Now()
+	info.LastAttempt = info.LastSuccess
+	return book.save()
+}
+
+// The function records a failed connection to the address. An address
+// that never worked is forgotten after MAX_ADDR_FAILURE failures.
+func (book *AddrBook) Failed(addr string) error {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	info, ok := book.addrs[addr]
+	if !ok {
+		return nil
+	}
+	info.Failures++
+	info.LastAttempt = time.Now()
+	if info.Successes == 0 && info.Failures >= MAX_ADDR_FAILURE {
+		delete(book.addrs, addr)
+	}
+	return book.save()
+}
+
+// The function forgets every address of the host of addr.
+func (book *AddrBook) RemoveHost(addr string) error {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	host := hostOf(addr)
+	for other := range book.addrs {
+		if hostOf(other) == host {
+			delete(book.addrs, other)
+		}
+	}
+	return book.save()
+}
+
+// The function returns how long to wait before trying
+// an address again after the given number of failures.
+func retryDelay(failures int) time.Duration {
+	delay := MIN_RECONNECT_DELAY
+	for i := 0; i < failures && delay < MAX_RECONNECT_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RECONNECT_DELAY {
+		delay = MAX_RECONNECT_DELAY
+	}
+	return delay
+}
+
+// The function returns up to n addresses to connect to, not in exclude,
+// the best ones first. Addresses are shuffled among the same score, and
+// the ones that failed recently are skipped for a while.
+func (book *AddrBook) Select(n int, exclude map[string]bool) []string {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	infos := []*AddrInfo{}
+	for addr, info := range book.addrs {
+		if exclude[addr] {
+			continue
+		}
+		if info.Failures > 0 && time.Since(info.LastAttempt) < retryDelay(info.Failures) {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	rand.Shuffle(len(infos), func(i, j int) { infos[i], infos[j] = infos[j], infos[i] })
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].score() > infos[j].score() })
+
+	addrs := []string{}
+	for _, info := range infos {
+		if len(addrs) >= n {
+			break
+		}
+		addrs = append(addrs, info.Addr)
+	}
+	return addrs
+}
+
+// The function returns up to n addresses we have connected to
+// successfully since our last failure, to share with other peers.
+func (book *AddrBook) GoodAddrs(n int) []string {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	addrs := []string{}
+	for addr, info := range book.addrs {
+		if len(addrs) >= n {
+			break
+		}
+		if info.Successes > 0 && info.Failures == 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (book *AddrBook) Get(addr string) *AddrInfo {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	info, ok := book.addrs[addr]
+	if !ok {
+		return nil
+	}
+	copied := *info
+	return &copied
+}
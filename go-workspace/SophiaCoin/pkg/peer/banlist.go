@@ -0,0 +1,170 @@
+package peer
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A banned host, and why it was banned.
+type BanInfo struct {
+	Host   string    `json:"host"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// The ban list keeps the hosts we refuse to talk to in a JSON file. Hosts
+// are banned by IP, whatever port they use. Every function of the ban
+// list is safe to call from several goroutines.
+type BanList struct {
+	path string
+	lock sync.Mutex
+	bans map[string]*BanInfo
+}
+
+// The function loads the ban list from path, or creates an
+// empty one if the file does not exist or is corrupt.
+func NewBanList(path string) (*BanList, error) {
+	list := &BanList{
+		path: path,
+		bans: map[string]*BanInfo{},
+	}
+	infos := []*BanInfo{}
+	ok, err := loadJSON(path, &infos)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return list, nil
+	}
+	for _, info := range infos {
+		list.bans[info.Host] = info
+	}
+	return list, nil
+}
+
+// The function returns the host of an address, or the
+// address itself if it has no port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// The function reads the JSON file at path into v, and returns whether
+// it did. A corrupt file is logged and moved aside to path.bad rather
+// than stopping the node, which starts without it.
+func loadJSON(path string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Printf("Corrupt %s, moved to %s.bad: %v\n", path, path, err)
+		if err := os.Rename(path, path+".bad"); err != nil {
+			log.Printf("Failed to move %s: %v\n", path, err)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// The function writes v to path as JSON. The file is replaced at once
+// by a synced copy, so that a crash leaves the old or the new one.
+func saveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // if not renamed
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// You should hold the lock before calling this function.
+func (list *BanList) save() error {
+	return saveJSON(list.path, list.list())
+}
+
+// You should hold the lock before calling this function.
+// Expired bans are forgotten meanwhile.
+func (list *BanList) list() []BanInfo {
+	now := time.Now()
+	infos := []BanInfo{}
+	for host, info := range list.bans {
+		if now.After(info.Until) {
+			delete(list.bans, host)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Host < infos[j].Host })
+	return infos
+}
+
+// The function bans the host of addr for the duration.
+func (list *BanList) Ban(addr string, duration time.Duration, reason string) error {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	host := hostOf(addr)
+	list.bans[host] = &BanInfo{
+		Host:   host,
+		Until:  time.Now().Add(duration),
+		Reason: reason,
+	}
+	return list.save()
+}
+
+// The function returns whether the host of addr is banned.
+func (list *BanList) IsBanned(addr string) bool {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	info, ok := list.bans[hostOf(addr)]
+	return ok && time.Now().Before(info.Until)
+}
+
+// The function returns the hosts banned now.
+func (list *BanList) List() []BanInfo {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	return list.list()
+}
+
+// The function lifts the ban of the host of addr, or every
+// ban if addr is empty.
+func (list *BanList) Clear(addr string) error {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if addr == "" {
+		list.bans = map[string]*BanInfo{}
+	} else {
+		delete(list.bans, hostOf(addr))
+	}
+	return list.save()
+}
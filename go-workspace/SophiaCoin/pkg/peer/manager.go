@@ -0,0 +1,285 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var (
+	PING_INTERVAL       = 30 * time.Second
+	PING_TIMEOUT        = 10 * time.Second
+	REQUEST_TIMEOUT     = time.Minute // of the other requests to a peer, so none hangs
+	MAX_PING_FAILURES   = 3           // failed pings in a row before a peer is evicted
+	MIN_RECONNECT_DELAY = time.Second
+	MAX_RECONNECT_DELAY = 5 * time.Minute
+)
+
+// The function is called on a new connection before the peer is added,
+// e.g. to exchange handshakes. The peer is dropped if it fails.
+type HandshakeFunc func(p *Peer) error
+
+// The manager keeps the set of connected peers. Every function
+// of the manager is safe to call from several goroutines.
+type Manager struct {
+	lock        sync.RWMutex
+	peers       map[string]*Peer
+	pending     map[string]bool // addresses being connected, with their direction
+	maxInbound  int
+	maxOutbound int
+	book        *AddrBook // may be nil
+	bans        *BanList  // may be nil
+	handshake   HandshakeFunc
+
+	scores   map[string]int // host -> misbehavior score
+	requests map[string]*requestWindow
+}
+
+// The manager records the result of every connection in the address book,
+// and fills the free outbound slots with addresses from it. Hosts in the
+// ban list are never connected to.
+func NewManager(maxInbound int, maxOutbound int, book *AddrBook, bans *BanList, handshake HandshakeFunc) *Manager {
+	return &Manager{
+		peers:       map[string]*Peer{},
+		pending:     map[string]bool{},
+		maxInbound:  maxInbound,
+		maxOutbound: maxOutbound,
+		book:        book,
+		bans:        bans,
+		handshake:   handshake,
+		scores:      map[string]int{},
+		requests:    map[string]*requestWindow{},
+	}
+}
+
+// You should hold the lock before calling this function.
+func (m *Manager) freeSlots(inbound bool) int {
+	count := 0
+	for _, p := range m.peers {
+		if p.Inbound == inbound {
+			count++
+		}
+	}
+	for _, pendingInbound := range m.pending {
+		if pendingInbound == inbound {
+			count++
+		}
+	}
+	if inbound {
+		return m.maxInbound - count
+	}
+	return m.maxOutbound - count
+}
+
+// You should hold the lock before calling this function.
+func (m *Manager) hasSlot(inbound bool) bool {
+	return m.freeSlots(inbound) > 0
+}
+
+func (m *Manager) HasSlot(inbound bool) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.hasSlot(inbound)
+}
+
+// The function connects to the address, runs the handshake and adds the
+// peer. If the address is already connected, the existing peer is returned.
+func (m *Manager) Connect(addr string, inbound bool) (*Peer, error) {
+	if m.IsBanned(addr) {
+		return nil, fmt.Errorf("peer.Manager.Connect: %s is banned", addr)
+	}
+	m.lock.Lock()
+	if p, ok := m.peers[addr]; ok {
+		m.lock.Unlock()
+		return p, nil
+	}
+	if _, ok := m.pending[addr]; ok {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("peer.Manager.Connect: Already connecting to %s", addr)
+	}
+	if !m.hasSlot(inbound) {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("peer.Manager.Connect: No free slot for %s", addr)
+	}
+	m.pending[addr] = inbound
+	m.lock.Unlock()
+
+	p, err := m.dial(addr, inbound)
+	if m.book != nil {
+		var bookErr error
+		if err != nil {
+			bookErr = m.book.Failed(addr)
+		} else if p.Type == pb.NodeType_FULL_NODE {
+			// Wallets are not shared with other nodes
+			bookErr = m.book.Good(addr)
+		}
+		if bookErr != nil {
+			log.Printf("Failed to save the address book: %v\n", bookErr)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.pending, addr)
+	if err != nil {
+		return nil, err
+	}
+	m.peers[addr] = p
+	return p, nil
+}
+
+func (m *Manager) dial(addr string, inbound bool) (*Peer, error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	p := &Peer{
+		Addr:     addr,
+		Client:   pb.NewBroadcastServiceClient(conn),
+		Inbound:  inbound,
+		Known:    NewKnownInventory(),
+		conn:     conn,
+		lastSeen: time.Now(),
+	}
+	if m.handshake != nil {
+		if err := m.handshake(p); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// The function keeps an outbound connection to the address, reconnecting
+// with an exponential backoff whenever the peer is lost.
+func (m *Manager) AddPersistent(addr string) {
+	if m.book != nil {
+		if err := m.book.Add(addr); err != nil {
+			log.Printf("Failed to save the address book: %v\n", err)
+		}
+	}
+	go func() {
+		delay := MIN_RECONNECT_DELAY
+		for {
+			if m.Get(addr) != nil {
+				time.Sleep(MIN_RECONNECT_DELAY)
+				continue
+			}
+			if _, err := m.Connect(addr, false); err != nil {
+				log.Printf("Failed to connect to %s: %v, retrying in %v\n", addr, err, delay)
+				time.Sleep(delay)
+				delay *= 2
+				if delay > MAX_RECONNECT_DELAY {
+					delay = MAX_RECONNECT_DELAY
+				}
+				continue
+			}
+			delay = MIN_RECONNECT_DELAY
+		}
+	}()
+}
+
+func (m *Manager) Get(addr string) *Peer {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.peers[addr]
+}
+
+// The function returns the connected peers, which can be
+// used without holding the lock.
+func (m *Manager) Peers() []*Peer {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// The function disconnects the peer.
+func (m *Manager) Remove(addr string) {
+	if p := m.Get(addr); p != nil {
+		m.remove(p)
+	}
+}
+
+// The function disconnects the peer, unless the address has
+// been connected again meanwhile.
+func (m *Manager) remove(p *Peer) {
+	m.lock.Lock()
+	if m.peers[p.Addr] == p {
+		delete(m.peers, p.Addr)
+	}
+	m.lock.Unlock()
+
+	p.conn.Close()
+}
+
+// The function pings every peer each PING_INTERVAL, and evicts
+// the ones failing MAX_PING_FAILURES pings in a row. The free
+// outbound slots are filled from the address book meanwhile.
+func (m *Manager) Run() {
+	go func() {
+		m.fillOutbound()
+		for range time.Tick(PING_INTERVAL) {
+			for _, p := range m.Peers() {
+				go m.ping(p)
+			}
+			m.fillOutbound()
+		}
+	}()
+}
+
+func (m *Manager) fillOutbound() {
+	if m.book == nil {
+		return
+	}
+
+	m.lock.RLock()
+	free := m.freeSlots(false)
+	exclude := map[string]bool{}
+	for addr := range m.peers {
+		exclude[addr] = true
+	}
+	for addr := range m.pending {
+		exclude[addr] = true
+	}
+	m.lock.RUnlock()
+
+	for _, addr := range m.book.Select(free, exclude) {
+		go m.Connect(addr, false)
+	}
+}
+
+func (m *Manager) ping(p *Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), PING_TIMEOUT)
+	defer cancel()
+
+	nonce := rand.Uint64()
+	start := time.Now()
+	reply, err := p.Client.Ping(ctx, &pb.PingMessage{Nonce: nonce})
+	if err == nil && reply.Nonce != nonce {
+		err = fmt.Errorf("peer.Manager.ping: Nonce mismatch")
+	}
+	if err != nil {
+		if p.failed() >= MAX_PING_FAILURES {
+			log.Printf("Evicting peer %s: %v\n", p.Addr, err)
+			m.remove(p)
+		}
+		return
+	}
+	p.seen(time.Since(start))
+	p.SetBestHeight(reply.BestHeight)
+}
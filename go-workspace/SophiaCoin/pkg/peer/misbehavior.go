@@ -0,0 +1,114 @@
+package peer
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Each host gets a misbehavior score, raised when it sends something no
+// honest node would. Past BAN_SCORE, the host is banned for BAN_DURATION
+// and its peers are dropped. Scores are kept by host, so a node cannot
+// start over by reconnecting from another port.
+
+var (
+	BAN_SCORE               = 100
+	BAN_DURATION            = 24 * time.Hour
+	REQUEST_WINDOW          = 10 * time.Second
+	MAX_REQUESTS_PER_WINDOW = 1000 // requests of a host in a window before it is flooding us
+)
+
+// How much each kind of misbehavior raises the score
+var (
+	SCORE_INVALID_POW         = 50
+	SCORE_INVALID_MERKLE_ROOT = 50
+	SCORE_UNDECODABLE         = 20
+	SCORE_FLOOD               = 20
+)
+
+type requestWindow struct {
+	start time.Time
+	count int
+}
+
+// The function raises the misbehavior score of the host of addr, and
+// bans it if the score reaches BAN_SCORE.
+func (m *Manager) Misbehaving(addr string, score int, reason string) {
+	host := hostOf(addr)
+
+	m.lock.Lock()
+	m.scores[host] += score
+	total := m.scores[host]
+	if total < BAN_SCORE {
+		m.lock.Unlock()
+		log.Printf("Peer %s misbehaving: %s, score %d\n", host, reason, total)
+		return
+	}
+	delete(m.scores, host)
+	dropped := []*Peer{}
+	for other, p := range m.peers {
+		if hostOf(other) == host {
+			dropped = append(dropped, p)
+		}
+	}
+	m.lock.Unlock()
+
+	log.Printf("Banning %s for %v: %s\n", host, BAN_DURATION, reason)
+	if m.bans != nil {
+		if err := m.bans.Ban(host, BAN_DURATION, reason); err != nil {
+			log.Printf("Failed to save the ban list: %v\n", err)
+		}
+	}
+	// Not to be connected to again, nor shared with other nodes
+	if m.book != nil {
+		if err := m.book.RemoveHost(host); err != nil {
+			log.Printf("Failed to save the address book: %v\n", err)
+		}
+	}
+	for _, p := range dropped {
+		m.remove(p)
+	}
+}
+
+// The function returns the misbehavior score of the host of addr.
+func (m *Manager) Score(addr string) int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.scores[hostOf(addr)]
+}
+
+func (m *Manager) IsBanned(addr string) bool {
+	return m.bans != nil && m.bans.IsBanned(addr)
+}
+
+// The function counts a request from the host of addr, and returns an
+// error if the host has sent more than MAX_REQUESTS_PER_WINDOW requests
+// in the current window. The score of the host is raised once a window.
+func (m *Manager) CountRequest(addr string) error {
+	host := hostOf(addr)
+	now := time.Now()
+
+	m.lock.Lock()
+	window, ok := m.requests[host]
+	if !ok || now.Sub(window.start) > REQUEST_WINDOW {
+		for other, w := range m.requests {
+			if now.Sub(w.start) > REQUEST_WINDOW {
+				delete(m.requests, other)
+			}
+		}
+		window = &requestWindow{start: now}
+		m.requests[host] = window
+	}
+	window.count++
+	count := window.count
+	m.lock.Unlock()
+
+	if count <= MAX_REQUESTS_PER_WINDOW {
+		return nil
+	}
+	if count == MAX_REQUESTS_PER_WINDOW+1 {
+		m.Misbehaving(addr, SCORE_FLOOD, "request flood")
+	}
+	return fmt.Errorf("peer.Manager.CountRequest: Too many requests from %s", host)
+}
@@ -0,0 +1,126 @@
+package peer
+
+import (
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"sync"
+	"time"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+
+	"google.golang.org/grpc"
+)
+
+var MAX_KNOWN_INVENTORY = 4096 // hashes remembered per peer
+
+// A node we are connected to. Inbound peers are the ones that
+// connected to us, outbound peers are the ones we chose.
+type Peer struct {
+	Addr    string
+	Client  pb.BroadcastServiceClient
+	Inbound bool
+	Known   *KnownInventory
+
+	// Set by the handshake, before the peer is added
+	Type     pb.NodeType
+	Services uint64
+
+	conn *grpc.ClientConn
+	lock sync.Mutex
+
+	bestHeight uint32
+	lastSeen   time.Time
+	latency    time.Duration
+	failures   int
+}
+
+func (p *Peer) HasServices(services uint64) bool {
+	return p.Services&services == services
+}
+
+func (p *Peer) BestHeight() uint32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.bestHeight
+}
+
+func (p *Peer) SetBestHeight(height uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.bestHeight = height
+}
+
+func (p *Peer) LastSeen() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.lastSeen
+}
+
+func (p *Peer) Latency() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.latency
+}
+
+// The function records a successful exchange with the peer.
+func (p *Peer) seen(latency time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastSeen = time.Now()
+	p.latency = latency
+	p.failures = 0
+}
+
+// The function records a failed exchange with the peer,
+// and returns the number of failures in a row.
+func (p *Peer) failed() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.failures++
+	return p.failures
+}
+
+// A bounded set of hashes a peer is known to have, because it announced
+// them or we did. The oldest hashes are forgotten first.
+type KnownInventory struct {
+	lock   sync.Mutex
+	hashes map[pri.HashResult]bool
+	order  []pri.HashResult
+	next   int
+}
+
+func NewKnownInventory() *KnownInventory {
+	return &KnownInventory{
+		hashes: map[pri.HashResult]bool{},
+		order:  make([]pri.HashResult, 0, MAX_KNOWN_INVENTORY),
+	}
+}
+
+func (k *KnownInventory) Add(hash pri.HashResult) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.hashes[hash] {
+		return
+	}
+	if len(k.order) < cap(k.order) {
+		k.order = append(k.order, hash)
+	} else {
+		delete(k.hashes, k.order[k.next])
+		k.order[k.next] = hash
+		k.next = (k.next + 1) % len(k.order)
+	}
+	k.hashes[hash] = true
+}
+
+func (k *KnownInventory) Has(hash pri.HashResult) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.hashes[hash]
+}
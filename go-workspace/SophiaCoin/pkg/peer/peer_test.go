@@ -0,0 +1,180 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	pri "os-project/SophiaCoin/pkg/primitives"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+func TestKnownInventory(t *testing.T) {
+	known := NewKnownInventory()
+	hashes := []pri.HashResult{}
+	for i := 0; i < MAX_KNOWN_INVENTORY+1; i++ {
+		hash := pri.HashResult{byte(i), byte(i >> 8), byte(i >> 16)}
+		hashes = append(hashes, hash)
+		known.Add(hash)
+	}
+	if known.Has(hashes[0]) {
+		t.Fatal("the oldest hash is not forgotten")
+	}
+	for _, hash := range hashes[1:] {
+		if !known.Has(hash) {
+			t.Fatalf("hash %x forgotten", hash)
+		}
+	}
+}
+
+func TestManagerSlots(t *testing.T) {
+	handshakes := 0
+	m := NewManager(1, 2, nil, nil, func(p *Peer) error {
+		handshakes++
+		if p.Addr == "127.0.0.1:3" {
+			return fmt.Errorf("handshake failed")
+		}
+		return nil
+	})
+
+	if _, err := m.Connect("127.0.0.1:1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Connect("127.0.0.1:2", true); err == nil {
+		t.Fatal("connected more inbound peers than the limit")
+	}
+	if _, err := m.Connect("127.0.0.1:1", false); err != nil || handshakes != 1 {
+		t.Fatalf("connecting twice: %v, %d handshakes", err, handshakes)
+	}
+	if _, err := m.Connect("127.0.0.1:3", false); err == nil || m.Get("127.0.0.1:3") != nil {
+		t.Fatal("kept a peer whose handshake failed")
+	}
+	if !m.HasSlot(false) {
+		t.Fatal("a failed handshake takes a slot")
+	}
+
+	m.Remove("127.0.0.1:1")
+	if len(m.Peers()) != 0 || !m.HasSlot(true) {
+		t.Fatal("removed peer still takes a slot")
+	}
+}
+
+func TestAddrBook(t *testing.T) {
+	path := t.TempDir() + "/peers.json"
+	book, err := NewAddrBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Add("127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3")
+	book.Good("127.0.0.1:2")
+	book.Failed("127.0.0.1:3")
+
+	// The book is reloaded from its file, as after a restart
+	book, err = NewAddrBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := book.Get("127.0.0.1:2"); info == nil || info.Successes != 1 {
+		t.Fatal("the address book is not persisted")
+	}
+	addrs := book.Select(3, nil)
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:2" || addrs[1] != "127.0.0.1:1" {
+		t.Fatalf("unexpected selection %v", addrs)
+	}
+	if addrs := book.Select(3, map[string]bool{"127.0.0.1:2": true}); len(addrs) != 1 {
+		t.Fatalf("unexpected selection %v", addrs)
+	}
+	if addrs := book.GoodAddrs(3); len(addrs) != 1 || addrs[0] != "127.0.0.1:2" {
+		t.Fatalf("unexpected good addresses %v", addrs)
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	tip := pri.HashResult{}
+	version := &pb.Version{
+		ProtocolVersion: PROTOCOL_VERSION,
+		Network:         NETWORK_MAGIC,
+		NodeType:        pb.NodeType_FULL_NODE,
+		Services:        SERVICE_BLOCKS,
+		Addr:            &pb.Address{Ip: "127.0.0.1", Port: "1"},
+		TipHash:         tip[:],
+	}
+	if err := CheckVersion(version); err != nil {
+		t.Fatal(err)
+	}
+
+	version.Network = NETWORK_MAGIC + 1
+	if CheckVersion(version) == nil {
+		t.Fatal("a node of another network is accepted")
+	}
+	version.Network = NETWORK_MAGIC
+	version.ProtocolVersion = MIN_PROTOCOL_VERSION - 1
+	if CheckVersion(version) == nil {
+		t.Fatal("an old protocol version is accepted")
+	}
+}
+
+func TestMisbehaving(t *testing.T) {
+	path := t.TempDir() + "/banlist.json"
+	bans, err := NewBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(1, 1, nil, bans, nil)
+
+	m.Misbehaving("127.0.0.1:1", BAN_SCORE-1, "test")
+	if m.IsBanned("127.0.0.1:1") {
+		t.Fatal("a host is banned below the threshold")
+	}
+	// The score is kept by host, whatever the port
+	m.Misbehaving("127.0.0.1:2", 1, "test")
+	if !m.IsBanned("127.0.0.1:3") {
+		t.Fatal("a host is not banned past the threshold")
+	}
+	if _, err := m.Connect("127.0.0.1:4", false); err == nil {
+		t.Fatal("a banned host is connected to")
+	}
+
+	// The ban list is reloaded from its file, as after a restart
+	bans, err = NewBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := bans.List(); len(list) != 1 || list[0].Host != "127.0.0.1" {
+		t.Fatalf("unexpected bans %v", list)
+	}
+	bans.Clear("127.0.0.1")
+	if bans.IsBanned("127.0.0.1:1") {
+		t.Fatal("a cleared ban is kept")
+	}
+	// A corrupt file is moved aside, and the list starts empty
+	if err := os.WriteFile(path, []byte("[{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bans, err = NewBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans.List()) != 0 {
+		t.Fatal("bans are loaded from a corrupt file")
+	}
+	if _, err := os.Stat(path + ".bad"); err != nil {
+		t.Fatal("the corrupt file is not moved aside")
+	}
+}
+
+func TestRequestFlood(t *testing.T) {
+	m := NewManager(1, 1, nil, nil, nil)
+	for i := 0; i < MAX_REQUESTS_PER_WINDOW; i++ {
+		if err := m.CountRequest("127.0.0.1:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.CountRequest("127.0.0.1:1") == nil {
+		t.Fatal("a flood is not detected")
+	}
+	if m.Score("127.0.0.1:1") != SCORE_FLOOD {
+		t.Fatalf("unexpected score %d", m.Score("127.0.0.1:1"))
+	}
+}
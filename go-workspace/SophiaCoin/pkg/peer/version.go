@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"fmt"
+	pri "os-project/SophiaCoin/pkg/primitives"
+
+	pb "os-project/SophiaCoin/pkg/rpc"
+)
+
+// The handshake tells which network a node is on, which version of the
+// protocol it speaks and what it serves, so that a node on another
+// network or speaking an older protocol is turned away before anything
+// else is exchanged.
+
+const (
+	PROTOCOL_VERSION     uint32 = 2 // the version this node speaks
+	MIN_PROTOCOL_VERSION uint32 = 2 // the oldest version it accepts, 1 had no version message
+)
+
+var NETWORK_MAGIC uint32 = 0x534f5048 // "SOPH", nodes of other networks are rejected
+
+const (
+	SERVICE_BLOCKS uint64 = 1 << iota // serves headers and blocks, GetHeaders and GetBlocks
+	SERVICE_RELAY                     // relays blocks and transactions by inventory
+)
+
+// The function checks that a node sending the version can talk to us.
+func CheckVersion(version *pb.Version) error {
+	if version.Network != NETWORK_MAGIC {
+		return fmt.Errorf("peer.CheckVersion: Wrong network %08x", version.Network)
+	}
+	if version.ProtocolVersion < MIN_PROTOCOL_VERSION {
+		return fmt.Errorf("peer.CheckVersion: Protocol version %d is too old", version.ProtocolVersion)
+	}
+	if version.Addr == nil {
+		return fmt.Errorf("peer.CheckVersion: Missing address")
+	}
+	switch version.NodeType {
+	case pb.NodeType_FULL_NODE, pb.NodeType_WALLET:
+	default:
+		return fmt.Errorf("peer.CheckVersion: Unknown node type %d", version.NodeType)
+	}
+	if len(version.TipHash) != len(pri.HashResult{}) {
+		return fmt.Errorf("peer.CheckVersion: Invalid tip hash")
+	}
+	return nil
+}
@@ -25,8 +25,8 @@ type Block struct {
 func GetGenesisBlock() *Block {
 	return &Block{
 		header: BlockHeader{
-			timestamp:  uint64(time.Date(2002, time.November, 11, 18, 12, 0, 0, time.UTC).Unix()),
-			nonce:      0xdeadbeef,
+			timestamp:  GENESIS_TIMESTAMP,
+			nonce:      GENESIS_NONCE,
 			prevBlock:  DEFAULT_HASH_RESULT,
 			merkleRoot: DEFAULT_HASH_RESULT,
 		},
@@ -48,7 +48,7 @@ func NewBlock(
 			index: height,
 		}},
 		txOuts: []TxOut{{
-			value:  total_tips + MINER_REWARD,
+			value:  total_tips + BlockReward(height),
 			pubKey: publicKey(minerPubkey.ToBytes()),
 		}},
 		signatures: []signature{},
@@ -115,6 +115,10 @@ func (bh *BlockHeader) GetTimestamp() uint64 {
 	return bh.timestamp
 }
 
+func (bh *BlockHeader) GetPrevHash() HashResult {
+	return bh.prevBlock
+}
+
 func (b *Block) serialize() []byte {
 	var result []byte
 	result = append(result, b.header.serialize()...)
@@ -174,6 +178,23 @@ func (b *Block) constructMerkleTree() {
 	b.tree = newMerkleTree(hashes)
 }
 
+// The function returns the merkle proof of the transaction at idx, which
+// can be checked against the merkle root in the header with VerifyProof.
+func (b *Block) GetMerkleProof(idx int) ([]HashResult, error) {
+	// Build a fresh tree instead of b.tree, blocks are shared between
+	// goroutines once they are on the chain.
+	hashes := make([]HashResult, 0, len(b.transactions))
+	for _, tx := range b.transactions {
+		hashes = append(hashes, tx.hash())
+	}
+	return newMerkleTree(hashes).proof(idx)
+}
+
+// The function returns the size of the serialized block in bytes.
+func (b *Block) Size() int {
+	return len(b.serialize())
+}
+
 func (b *Block) GetTransactions() []Transaction {
 	return b.transactions
 }
@@ -182,6 +203,32 @@ func (b *Block) GetHeader() *BlockHeader {
 	return &b.header
 }
 
+func (bh *BlockHeader) SetNonce(nonce uint32) {
+	bh.nonce = nonce
+}
+
+func (bh *BlockHeader) SetTimestamp(timestamp uint64) {
+	bh.timestamp = timestamp
+}
+
+// The function returns a copy of the block whose header and coinbase
+// can be changed, e.g. by a miner, without changing the block.
+func (b *Block) Copy() *Block {
+	return &Block{
+		header:       b.header,
+		transactions: append([]Transaction{}, b.transactions...),
+	}
+}
+
+// The function stores the extra nonce in the coinbase, where a
+// signature is not checked, and updates the merkle root, so that a
+// miner who has tried every nonce gets new headers to try.
+func (b *Block) SetExtraNonce(extraNonce uint64) {
+	b.transactions[0].signatures = []signature{uint64ToBytes(extraNonce)}
+	b.constructMerkleTree()
+	b.header.merkleRoot = b.tree.root()
+}
+
 func (b *Block) RandomizeNonce() {
 	var err error
 	four_bytes := crypto.RandBytes(4)
@@ -2,6 +2,7 @@ package primitives
 
 import (
 	"crypto/sha256"
+	"math/big"
 	"os-project/SophiaCoin/pkg/crypto"
 )
 
@@ -25,6 +26,10 @@ func (b *Block) VerifyMerkleRoot() bool {
 }
 
 func (b *Block) VerifyDifficulty(height int, difficulty uint32) bool {
+	return b.header.VerifyDifficulty(height, difficulty)
+}
+
+func (b *BlockHeader) VerifyDifficulty(height int, difficulty uint32) bool {
 	if height == 0 {
 		return true
 	}
@@ -38,23 +43,93 @@ func (b *Block) VerifyDifficulty(height int, difficulty uint32) bool {
 	return true
 }
 
+// The function computes the difficulty of the next retarget period, given
+// the difficulty of the last period and the time (in seconds) it took to
+// mine the given number of blocks. Each halving (doubling) of the expected
+// time adds (removes) one bit, at most MAX_DIFFICULTY_STEP bits at once.
+func NextDifficulty(last uint32, timespan int64, blocks uint32) uint32 {
+	if blocks == 0 {
+		return last
+	}
+	expected := int64(uint64(blocks) * TARGET_BLOCK_TIME)
+	if timespan < 1 {
+		timespan = 1
+	}
+
+	next := last
+	for step := uint32(0); step < MAX_DIFFICULTY_STEP; step++ {
+		if timespan*2 <= expected && next < 255 {
+			next++
+			timespan *= 2
+		} else if timespan >= expected*2 && next > 1 {
+			next--
+			timespan /= 2
+		} else {
+			break
+		}
+	}
+	return next
+}
+
+// The function returns the expected number of hashes needed to mine a
+// block of the given difficulty, i.e. 2^difficulty.
+func BlockWork(difficulty uint32) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+// This function verifies whether the block timestamp is not earlier than
+// the median time of the previous blocks and not too far in the future.
+func (b *Block) VerifyTimestamp(medianTime uint64, now uint64) bool {
+	if b.header.timestamp < medianTime {
+		return false
+	}
+	return b.header.timestamp <= now+MAX_FUTURE_BLOCK_TIME
+}
+
+// This function verifies whether the block is not larger than MAX_BLOCK_SIZE.
+func (b *Block) VerifySize() bool {
+	return b.Size() <= MAX_BLOCK_SIZE
+}
+
+// The function returns the block reward at the given height, which
+// halves every HALVING_INTERVAL blocks until it reaches zero.
+func BlockReward(height uint32) uint64 {
+	halvings := height / HALVING_INTERVAL
+	if halvings >= 64 {
+		return 0
+	}
+	return MINER_REWARD >> halvings
+}
+
 // This function verifies whether the coinbase transaction is valid.
 // It checks whether the coinbase transaction has the correct structure
 // and whether the coinbase transaction has the correct value given
 // tips by other transactions.
 func (b *Block) VerifyCoinbase(height uint32, tips uint64) bool {
+	if len(b.transactions) == 0 {
+		return false
+	}
 	coinbase := b.transactions[0]
-	if len(coinbase.GetTxIns()) != 1 {
+	if !coinbase.IsCoinbase() {
 		return false
 	}
 	txIn := coinbase.GetTxIns()[0]
-	if txIn.GetTxPtr() != DEFAULT_HASH_RESULT {
+	if txIn.GetIndex() != height {
 		return false
 	}
-	if txIn.GetIndex() != height {
+
+	limit := BlockReward(height) + tips
+	if limit < tips {
 		return false
 	}
-	return true
+	var total uint64 = 0
+	for _, txOut := range coinbase.GetTxOuts() {
+		if total+txOut.GetValue() < total {
+			return false
+		}
+		total += txOut.GetValue()
+	}
+	return total <= limit
 }
 
 func (tx *Transaction) VerifySignature(pubkey []*crypto.PublicKey) bool {
@@ -68,9 +143,10 @@ func (tx *Transaction) VerifySignature(pubkey []*crypto.PublicKey) bool {
 
 	for i, txIn := range tx.GetTxIns() {
 		raw := &Transaction{
-			txIns:      []TxIn{txIn},
-			txOuts:     tx.GetTxOuts(),
-			signatures: []signature{},
+			txIns:       []TxIn{txIn},
+			txOuts:      tx.GetTxOuts(),
+			signatures:  []signature{},
+			replaceable: tx.replaceable,
 		}
 
 		b := sha256.Sum256(raw.serialize())
@@ -95,9 +171,10 @@ func (tx *Transaction) Sign(keys ...*crypto.Key) {
 			key = keys[i]
 		}
 		raw := &Transaction{
-			txIns:      []TxIn{txIn},
-			txOuts:     tx.GetTxOuts(),
-			signatures: []signature{},
+			txIns:       []TxIn{txIn},
+			txOuts:      tx.GetTxOuts(),
+			signatures:  []signature{},
+			replaceable: tx.replaceable,
 		}
 
 		b := sha256.Sum256(raw.serialize())
@@ -0,0 +1,135 @@
+package primitives
+
+import (
+	"testing"
+
+	"os-project/SophiaCoin/pkg/crypto"
+)
+
+func newTestKey(t *testing.T) *crypto.Key {
+	key, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// The function replaces the coinbase of the block by one with the given
+// outputs and txIn index, and recomputes the merkle root.
+func withCoinbase(b *Block, index uint32, txOuts ...TxOut) *Block {
+	coinbase := NewTx([]TxIn{*NewTxIn(DEFAULT_HASH_RESULT, index)}, txOuts, []signature{})
+	crafted := &Block{
+		header:       b.header,
+		transactions: append([]Transaction{*coinbase}, b.transactions[1:]...),
+	}
+	crafted.constructMerkleTree()
+	crafted.header.merkleRoot = crafted.tree.root()
+	return crafted
+}
+
+func TestBlockReward(t *testing.T) {
+	cases := []struct {
+		height uint32
+		reward uint64
+	}{
+		{1, MINER_REWARD},
+		{HALVING_INTERVAL - 1, MINER_REWARD},
+		{HALVING_INTERVAL, MINER_REWARD / 2},
+		{2*HALVING_INTERVAL + 1, MINER_REWARD / 4},
+		{11 * HALVING_INTERVAL, 0},
+	}
+	for _, c := range cases {
+		if got := BlockReward(c.height); got != c.reward {
+			t.Errorf("BlockReward(%d) = %d, want %d", c.height, got, c.reward)
+		}
+	}
+}
+
+func TestVerifyCoinbase(t *testing.T) {
+	miner := newTestKey(t).GetPublicKey()
+	other := newTestKey(t).GetPublicKey()
+	const height, tips = uint32(5), uint64(7)
+	reward := BlockReward(height)
+	block := NewBlock(DEFAULT_HASH_RESULT, height, miner, tips)
+
+	cases := []struct {
+		name  string
+		block *Block
+		tips  uint64
+		valid bool
+	}{
+		{"reward plus tips", block, tips, true},
+		{"tips not collected", withCoinbase(block, height, *NewTxOut(reward, miner)), tips, true},
+		{"split outputs", withCoinbase(block, height,
+			*NewTxOut(reward, miner), *NewTxOut(tips, other)), tips, true},
+		{"more than tips", block, tips - 1, false},
+		{"inflated output", withCoinbase(block, height, *NewTxOut(reward+tips+1, miner)), tips, false},
+		{"inflated split outputs", withCoinbase(block, height,
+			*NewTxOut(reward, miner), *NewTxOut(tips+1, other)), tips, false},
+		{"overflowing outputs", withCoinbase(block, height,
+			*NewTxOut(^uint64(0), miner), *NewTxOut(2, other)), tips, false},
+		{"wrong height", withCoinbase(block, height+1, *NewTxOut(reward, miner)), tips, false},
+	}
+	for _, c := range cases {
+		if got := c.block.VerifyCoinbase(height, c.tips); got != c.valid {
+			t.Errorf("%s: VerifyCoinbase = %v, want %v", c.name, got, c.valid)
+		}
+	}
+
+	if (&Block{}).VerifyCoinbase(height, tips) {
+		t.Error("empty block: VerifyCoinbase = true, want false")
+	}
+}
+
+func TestVerifyCoinbaseAfterHalving(t *testing.T) {
+	miner := newTestKey(t).GetPublicKey()
+	height := HALVING_INTERVAL
+
+	block := NewBlock(DEFAULT_HASH_RESULT, height, miner, 0)
+	if !block.VerifyCoinbase(height, 0) {
+		t.Error("halved reward: VerifyCoinbase = false, want true")
+	}
+
+	block = withCoinbase(block, height, *NewTxOut(MINER_REWARD, miner))
+	if block.VerifyCoinbase(height, 0) {
+		t.Error("pre-halving reward: VerifyCoinbase = true, want false")
+	}
+}
+
+func TestReplaceableSignal(t *testing.T) {
+	key := newTestKey(t)
+	txIns := []TxIn{*NewTxIn(HashResult{1}, 0)}
+	txOuts := []TxOut{*NewTxOut(10, key.GetPublicKey())}
+	pubs := []*crypto.PublicKey{key.GetPublicKey()}
+
+	final := NewTx(txIns, txOuts, nil)
+	replaceable := NewTx(txIns, txOuts, nil)
+	replaceable.SetReplaceable()
+	// The number of txins is little endian, the signal is its top bit
+	if final.serialize()[3] != 0 || replaceable.serialize()[3] != 0x80 {
+		t.Fatal("the signal is not serialized in the number of txins")
+	}
+	replaceable.Sign(key)
+
+	data, err := Serialize(replaceable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := Deserialize(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := object.(*Transaction)
+	if !decoded.IsReplaceable() || len(decoded.GetTxIns()) != 1 || Hash(decoded) != Hash(replaceable) {
+		t.Fatal("the signal does not round-trip")
+	}
+	if !decoded.VerifySignature(pubs) {
+		t.Fatal("invalid signature of a replaceable transaction")
+	}
+
+	// The signatures cover the signal
+	decoded.replaceable = false
+	if decoded.VerifySignature(pubs) {
+		t.Fatal("the signal can be removed without invalidating the signatures")
+	}
+}
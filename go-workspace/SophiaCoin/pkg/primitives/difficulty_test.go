@@ -0,0 +1,39 @@
+package primitives
+
+import "testing"
+
+func TestNextDifficulty(t *testing.T) {
+	defer func(target uint64, step uint32) {
+		TARGET_BLOCK_TIME, MAX_DIFFICULTY_STEP = target, step
+	}(TARGET_BLOCK_TIME, MAX_DIFFICULTY_STEP)
+	TARGET_BLOCK_TIME, MAX_DIFFICULTY_STEP = 30, 2
+	const blocks = 15
+	const expected = blocks * 30
+
+	cases := []struct {
+		name     string
+		last     uint32
+		timespan int64
+		blocks   uint32
+		next     uint32
+	}{
+		{"on time", 10, expected, blocks, 10},
+		{"slightly fast", 10, expected*2/3 + 1, blocks, 10},
+		{"twice as fast", 10, expected / 2, blocks, 11},
+		{"four times as fast", 10, expected / 4, blocks, 12},
+		{"fast, clamped", 10, expected / 16, blocks, 12},
+		{"no time", 10, 0, blocks, 12},
+		{"timestamps going back", 10, -100, blocks, 12},
+		{"twice as slow", 10, expected * 2, blocks, 9},
+		{"slow, clamped", 10, expected * 16, blocks, 8},
+		{"slow, lowest difficulty", 1, expected * 16, blocks, 1},
+		{"fast, highest difficulty", 255, expected / 16, blocks, 255},
+		{"no blocks", 10, 1, 0, 10},
+	}
+	for _, c := range cases {
+		if got := NextDifficulty(c.last, c.timespan, c.blocks); got != c.next {
+			t.Errorf("%s: NextDifficulty(%d, %d, %d) = %d, want %d",
+				c.name, c.last, c.timespan, c.blocks, got, c.next)
+		}
+	}
+}
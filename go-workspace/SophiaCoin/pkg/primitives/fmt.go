@@ -19,6 +19,15 @@ func (hash HashResult) String() string {
 	return fmt.Sprintf("\"Hash+0x%x\"", hash[:])
 }
 
+// "%x" prints the hash in plain hex, as in logs and errors.
+func (hash HashResult) Format(f fmt.State, verb rune) {
+	if verb == 'x' {
+		fmt.Fprintf(f, "%x", hash[:])
+		return
+	}
+	fmt.Fprint(f, hash.String())
+}
+
 func (pubKey publicKey) String() string {
 	return fmt.Sprintf("\"PublicKey+0x%x\"", pubKey[:])
 }
@@ -2,16 +2,30 @@ package primitives
 
 import (
 	"crypto/sha256"
+	"errors"
 )
 
 // var DEFAULT_HASH_RESULT = HashResult(sha256.Sum256([]byte("")))
 
+// The merkle tree is built level by level from the transaction hashes.
+// If a level has an odd number of nodes, the last node is moved up to the
+// next level unchanged. This is the rule the blocks already on the chain
+// were built with, so it must not change. In a proof the missing sibling
+// of such a node is DEFAULT_HASH_RESULT, so a proof always has exactly
+// depth-1 sibling hashes.
 type merkleTree struct {
 	nodes  [][]HashResult
 	depth  uint32
 	length uint32
 }
 
+func hashPair(left HashResult, right HashResult) HashResult {
+	data := make([]byte, 0, 2*len(left))
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha256.Sum256(data)
+}
+
 func newMerkleTree(hash []HashResult) *merkleTree {
 	n := len(hash)
 	tree := merkleTree{
@@ -24,20 +38,15 @@ func newMerkleTree(hash []HashResult) *merkleTree {
 	}
 
 	tree.nodes = append(tree.nodes, make([]HashResult, n))
-	for i := 0; i < n; i++ {
-		tree.nodes[0][i] = hash[i]
-	}
+	copy(tree.nodes[0], hash)
 	tree.depth = 1
 	for n > 1 {
 		tree.nodes = append(tree.nodes, make([]HashResult, (n+1)/2))
 		for i := 0; i < n; i += 2 {
-			data := tree.nodes[tree.depth-1][i][:]
 			if i+1 < n {
-				data = append(data, tree.nodes[tree.depth-1][i+1][:]...)
-				tree.nodes[tree.depth][i/2] = sha256.Sum256(data)
+				tree.nodes[tree.depth][i/2] = hashPair(tree.nodes[tree.depth-1][i], tree.nodes[tree.depth-1][i+1])
 			} else {
-				data = append(data, DEFAULT_HASH_RESULT[:]...)
-				tree.nodes[tree.depth][i/2] = HashResult(data)
+				tree.nodes[tree.depth][i/2] = tree.nodes[tree.depth-1][i]
 			}
 		}
 		tree.depth++
@@ -55,72 +64,80 @@ func (tree *merkleTree) root() HashResult {
 }
 
 func (tree *merkleTree) append(hash ...HashResult) {
-	n := len(hash)
-	if n == 0 {
+	if len(hash) == 0 {
 		return
 	}
-	// Compute new depth and initialize new nodes
-	tree.length += uint32(n)
-	temp_length := tree.length
-	new_depth := 0
-	for temp_length > 0 {
-		temp_length /= 2
-		new_depth++
+
+	// Every level on the path of the new leaves changes, so the simplest
+	// way to keep the odd-leaf rule consistent is to rebuild the tree.
+	leaves := make([]HashResult, 0, int(tree.length)+len(hash))
+	if tree.depth > 0 {
+		leaves = append(leaves, tree.nodes[0]...)
 	}
-	var_length := n
-	for i := 0; i < new_depth; i++ {
-		if i < int(tree.depth) {
-			tree.nodes[i] = append(tree.nodes[i], make([]HashResult, var_length)...)
-			var_length = (var_length + 1) / 2
-		} else {
-			tree.nodes = append(tree.nodes, make([]HashResult, var_length))
-			var_length = (var_length + 1) / 2
-		}
+	leaves = append(leaves, hash...)
+	*tree = *newMerkleTree(leaves)
+}
+
+// The function returns the sibling hashes on the path from the leaf at idx
+// to the root, from the bottom level to the top. A missing sibling (the last
+// node of an odd level) is represented by DEFAULT_HASH_RESULT.
+func (tree *merkleTree) proof(idx int) ([]HashResult, error) {
+	if idx < 0 || idx >= int(tree.length) {
+		return nil, errors.New("primitives.merkleTree.proof: Index out of range")
 	}
-	tree.depth = uint32(new_depth)
 
-	// Append new nodes
-	for i := 0; i < n; i++ {
-		idx := tree.length - uint32(n) + uint32(i)
-		tree.nodes[0][idx] = hash[i]
-		temp_depth := 1
-		for idx > 0 {
-			if idx%2 == 1 {
-				tree.nodes[temp_depth][idx/2] = sha256.Sum256(append(tree.nodes[tree.depth-1][idx-1][:], tree.nodes[tree.depth-1][idx][:]...))
-			} else {
-				tree.nodes[temp_depth][idx/2] = sha256.Sum256(append(tree.nodes[tree.depth-1][idx][:], DEFAULT_HASH_RESULT[:]...))
-			}
-			idx /= 2
-			temp_depth++
+	proof := make([]HashResult, 0, tree.depth)
+	for level := 0; level+1 < int(tree.depth); level++ {
+		sibling := idx ^ 1
+		if sibling < len(tree.nodes[level]) {
+			proof = append(proof, tree.nodes[level][sibling])
+		} else {
+			proof = append(proof, DEFAULT_HASH_RESULT)
 		}
+		idx /= 2
 	}
-
-	return
+	return proof, nil
 }
 
-// We should use default hash result to represent empty hash in proof
+// We should use default hash result to represent empty hash in proof.
+// No transaction or inner node hashes to DEFAULT_HASH_RESULT, so a left
+// node with that sibling is the last node of its level and is moved up.
 func VerifyProof(root HashResult, proof []HashResult, leaf HashResult, idx int) bool {
-	return true
-	if len(proof) == 0 {
-		return root == leaf && idx == 0
-	}
-	if idx == 0 {
-		return root == leaf
+	if idx < 0 {
+		return false
 	}
-	for idx > 0 {
-		if len(proof) == 0 {
-			return false
-		}
+	for _, sibling := range proof {
 		if idx%2 == 1 {
-			leaf = sha256.Sum256(append(proof[0][:], leaf[:]...))
-		} else {
-			leaf = sha256.Sum256(append(leaf[:], proof[0][:]...))
+			leaf = hashPair(sibling, leaf)
+		} else if sibling != DEFAULT_HASH_RESULT {
+			leaf = hashPair(leaf, sibling)
 		}
 		idx /= 2
-		proof = proof[1:]
 	}
-	if len(proof) != 0 {
+	if idx != 0 {
 		return false
 	}
 	return root == leaf
 }
+
+// The wire format of a merkle proof is the concatenation of the sibling
+// hashes, from the bottom level to the top.
+func EncodeProof(proof []HashResult) []byte {
+	result := make([]byte, 0, len(proof)*len(HashResult{}))
+	for _, hash := range proof {
+		result = append(result, hash[:]...)
+	}
+	return result
+}
+
+func DecodeProof(data []byte) ([]HashResult, error) {
+	size := len(HashResult{})
+	if len(data)%size != 0 {
+		return nil, errors.New("primitives.DecodeProof: Invalid proof length")
+	}
+	proof := make([]HashResult, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		proof = append(proof, HashResult(data[i:i+size]))
+	}
+	return proof, nil
+}
@@ -0,0 +1,78 @@
+package primitives
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func testLeaves(n int) []HashResult {
+	leaves := make([]HashResult, n)
+	for i := range leaves {
+		leaves[i] = sha256.Sum256([]byte(fmt.Sprintf("tx %d", i)))
+	}
+	return leaves
+}
+
+func TestMerkleOddLeaf(t *testing.T) {
+	leaves := testLeaves(3)
+	want := hashPair(hashPair(leaves[0], leaves[1]), leaves[2])
+	if got := newMerkleTree(leaves).root(); got != want {
+		t.Fatalf("root = %x, want %x", got, want)
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8} {
+		leaves := testLeaves(n)
+		tree := newMerkleTree(leaves)
+		root := tree.root()
+		for idx := 0; idx < n; idx++ {
+			proof, err := tree.proof(idx)
+			if err != nil {
+				t.Fatalf("%d leaves, index %d: %v", n, idx, err)
+			}
+			if len(proof) != int(tree.depth)-1 {
+				t.Errorf("%d leaves, index %d: proof has %d hashes, want %d", n, idx, len(proof), tree.depth-1)
+			}
+			decoded, err := DecodeProof(EncodeProof(proof))
+			if err != nil {
+				t.Fatalf("%d leaves, index %d: %v", n, idx, err)
+			}
+			if !VerifyProof(root, decoded, leaves[idx], idx) {
+				t.Errorf("%d leaves, index %d: valid proof rejected", n, idx)
+			}
+
+			if len(decoded) > 0 {
+				tampered := append([]HashResult{}, decoded...)
+				tampered[0][0] ^= 1
+				if VerifyProof(root, tampered, leaves[idx], idx) {
+					t.Errorf("%d leaves, index %d: tampered sibling accepted", n, idx)
+				}
+				if VerifyProof(root, decoded[:len(decoded)-1], leaves[idx], idx) {
+					t.Errorf("%d leaves, index %d: truncated proof accepted", n, idx)
+				}
+			}
+			for _, wrong := range []int{-1, idx + 1, idx + n} {
+				if VerifyProof(root, decoded, leaves[idx], wrong) {
+					t.Errorf("%d leaves, index %d: accepted at index %d", n, idx, wrong)
+				}
+			}
+		}
+		if _, err := tree.proof(n); err == nil {
+			t.Errorf("%d leaves: proof for index %d out of range", n, n)
+		}
+	}
+}
+
+func TestDecodeProof(t *testing.T) {
+	encoded := EncodeProof(testLeaves(3))
+	for _, length := range []int{1, 31, 33, len(encoded) - 1} {
+		if _, err := DecodeProof(encoded[:length]); err == nil {
+			t.Errorf("truncated encoding of %d bytes decoded", length)
+		}
+	}
+	if proof, err := DecodeProof(nil); err != nil || len(proof) != 0 {
+		t.Errorf("empty encoding: %v, %v", proof, err)
+	}
+}
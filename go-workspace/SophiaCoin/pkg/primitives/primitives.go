@@ -30,6 +30,35 @@ var (
 	// DO NOT CHANGE THE VALUES
 	DEFAULT_HASH_RESULT HashResult = sha256.Sum256([]byte{})
 	MINER_REWARD                   = uint64(1024)
+
+	// The genesis block only differs between networks by these, so
+	// that a node cannot mix up the chains of two networks.
+	GENESIS_TIMESTAMP = uint64(1037038320) // 2002-11-11 18:12:00 UTC
+	GENESIS_NONCE     = uint32(0xdeadbeef)
+
+	// The block reward starts at MINER_REWARD and halves every
+	// HALVING_INTERVAL blocks. A coinbase output can only be spent
+	// after COINBASE_MATURITY blocks (including its own) are on the chain.
+	HALVING_INTERVAL  = uint32(4096)
+	COINBASE_MATURITY = uint32(10)
+
+	// Difficulty is the number of leading zero bits of a block hash.
+	// It is recomputed every RETARGET_INTERVAL blocks so that blocks
+	// are mined every TARGET_BLOCK_TIME seconds on average.
+	INITIAL_DIFFICULTY  = uint32(4)
+	RETARGET_INTERVAL   = uint32(16)
+	TARGET_BLOCK_TIME   = uint64(30)
+	MAX_DIFFICULTY_STEP = uint32(2)
+
+	// A block timestamp must not be earlier than the median of the
+	// previous MEDIAN_TIME_SPAN blocks, and not be more than
+	// MAX_FUTURE_BLOCK_TIME seconds ahead of the local clock.
+	MEDIAN_TIME_SPAN      = 11
+	MAX_FUTURE_BLOCK_TIME = uint64(2 * 60 * 60)
+
+	// The serialized size of a block, header and coinbase included,
+	// must not exceed MAX_BLOCK_SIZE bytes.
+	MAX_BLOCK_SIZE = 1 << 20
 )
 
 func Serialize(data Serializable) ([]byte, error) {
@@ -7,19 +7,29 @@ import (
 	"os-project/SophiaCoin/pkg/crypto"
 )
 
+// A transaction signals that it can be replaced by one paying a higher
+// fee while it is pending by setting this bit of its number of txins, so
+// that the transactions not signaling keep their serialization.
+const replaceableFlag = uint32(1) << 31
+
 type Transaction struct {
-	txIns      []TxIn
-	txOuts     []TxOut
-	signatures []signature
+	txIns       []TxIn
+	txOuts      []TxOut
+	signatures  []signature
+	replaceable bool
 }
 
 func NewTx(txIns []TxIn, txOuts []TxOut, signatures []signature) *Transaction {
-	return &Transaction{txIns, txOuts, signatures}
+	return &Transaction{txIns: txIns, txOuts: txOuts, signatures: signatures}
 }
 
 func (tx *Transaction) serialize() []byte {
 	var result []byte
-	result = append(result, uint32ToBytes(uint32(len(tx.txIns)))...)
+	txInsLen := uint32(len(tx.txIns))
+	if tx.replaceable {
+		txInsLen |= replaceableFlag
+	}
+	result = append(result, uint32ToBytes(txInsLen)...)
 	for _, txIn := range tx.txIns {
 		result = append(result, txIn.serialize()...)
 	}
@@ -45,6 +55,8 @@ func (tx *Transaction) deserialize(data io.Reader) error {
 	if err != nil {
 		return err
 	}
+	tx.replaceable = txInsLen&replaceableFlag != 0
+	txInsLen &^= replaceableFlag
 	for i := 0; i < int(txInsLen); i++ {
 		TxIn := TxIn{}
 		err = TxIn.deserialize(data)
@@ -88,6 +100,21 @@ func (tx *Transaction) hash() HashResult {
 	return sha256.Sum256(tx.serialize())
 }
 
+// The function returns the size of the serialized transaction in bytes.
+func (tx *Transaction) Size() int {
+	return len(tx.serialize())
+}
+
+// The function marks the transaction as replaceable while it is pending.
+// It must be called before Sign, the signatures cover the signal.
+func (tx *Transaction) SetReplaceable() {
+	tx.replaceable = true
+}
+
+func (tx *Transaction) IsReplaceable() bool {
+	return tx.replaceable
+}
+
 func (tx *Transaction) GetTxIns() []TxIn {
 	return tx.txIns
 }
@@ -96,6 +123,12 @@ func (tx *Transaction) GetTxOuts() []TxOut {
 	return tx.txOuts
 }
 
+// A coinbase transaction has a single txIn pointing to DEFAULT_HASH_RESULT,
+// whose index is the height of the block.
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.txIns) == 1 && tx.txIns[0].txPtr == DEFAULT_HASH_RESULT
+}
+
 // The function returns whether the transaction relates to the public key
 // in its txins if isIn is true, or relates to the public key in its txouts
 // otherwise. It returns a list of indices of txins or txouts that relate to
@@ -103,12 +136,13 @@ func (tx *Transaction) GetTxOuts() []TxOut {
 func (tx *Transaction) RelatesTo(pubkey crypto.PublicKey, isIn bool) []int {
 	pubkeyBytes := pubkey.ToBytes()
 	ret := []int{}
-	if isIn && len(tx.signatures) > 0 {
+	if isIn && len(tx.signatures) > 0 && !tx.IsCoinbase() {
 		for i, txIn := range tx.txIns {
 			raw := &Transaction{
-				txIns:      []TxIn{txIn},
-				txOuts:     tx.txOuts,
-				signatures: []signature{},
+				txIns:       []TxIn{txIn},
+				txOuts:      tx.txOuts,
+				signatures:  []signature{},
+				replaceable: tx.replaceable,
 			}
 			raw_bytes := sha256.Sum256(raw.serialize())
 			if pubkey.Verify(raw_bytes[:], tx.signatures[i][:]) {
@@ -0,0 +1,129 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"sort"
+)
+
+var (
+	// Branch and bound accepts coins exceeding the target by up to
+	// BNB_TOLERANCE, which then goes to the fee instead of a change
+	// output, and gives up after BNB_MAX_TRIES steps.
+	BNB_TOLERANCE = uint64(0)
+	BNB_MAX_TRIES = 100000
+)
+
+// An output of the chain paying one of the keys of the wallet.
+type Utxo struct {
+	TxIn   pri.TxIn
+	Value  uint64
+	Key    string // the name of the key it pays
+	Height int    // of the block holding it
+	// Paid by a coinbase transaction, spendable once mature
+	Coinbase bool
+}
+
+// How the coins spent by a transaction are picked.
+type CoinSelection int
+
+const (
+	// The largest coins first, for the fewest inputs
+	LargestFirst CoinSelection = iota
+	// Coins adding up to the amount exactly, so that no change is left,
+	// or the largest coins first if there are none
+	BranchAndBound
+	// Coins in random order, so that payments do not reveal which
+	// coins a wallet holds
+	RandomCoins
+)
+
+// The function sorts the coins by value, the largest first, and by
+// outpoint among the same value.
+func sortCoins(coins []Utxo) {
+	sort.Slice(coins, func(i, j int) bool {
+		if coins[i].Value != coins[j].Value {
+			return coins[i].Value > coins[j].Value
+		}
+		a, b := coins[i].TxIn.GetTxPtr(), coins[j].TxIn.GetTxPtr()
+		if c := bytes.Compare(a[:], b[:]); c != 0 {
+			return c < 0
+		}
+		return coins[i].TxIn.GetIndex() < coins[j].TxIn.GetIndex()
+	})
+}
+
+// The function takes coins in order until they add up to the target.
+func accumulate(coins []Utxo, target uint64) ([]Utxo, error) {
+	selected := []Utxo{}
+	var total uint64 = 0
+	for _, coin := range coins {
+		if total >= target {
+			break
+		}
+		selected = append(selected, coin)
+		total += coin.Value
+	}
+	if total < target {
+		return nil, fmt.Errorf("Wallet.SelectCoins: Insufficient balance %d for %d", total, target)
+	}
+	return selected, nil
+}
+
+// The function searches for coins adding up to between target and
+// target+BNB_TOLERANCE, trying the largest coins first. The coins must
+// be sorted by sortCoins. It returns nil if there are none.
+func branchAndBound(coins []Utxo, target uint64) []Utxo {
+	// remaining[i] is the sum of coins[i:]
+	remaining := make([]uint64, len(coins)+1)
+	for i := len(coins) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + coins[i].Value
+	}
+
+	tries := 0
+	selected := []Utxo{}
+	var search func(i int, total uint64) bool
+	search = func(i int, total uint64) bool {
+		tries++
+		if total >= target {
+			return total <= target+BNB_TOLERANCE
+		}
+		if i == len(coins) || total+remaining[i] < target || tries > BNB_MAX_TRIES {
+			return false
+		}
+		selected = append(selected, coins[i])
+		if search(i+1, total+coins[i].Value) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+		return search(i+1, total)
+	}
+	if !search(0, 0) {
+		return nil
+	}
+	return selected
+}
+
+// The function picks coins adding up to at least target with the given
+// strategy. The coins are not changed.
+func SelectCoins(coins []Utxo, target uint64, strategy CoinSelection) ([]Utxo, error) {
+	sorted := append([]Utxo{}, coins...)
+	sortCoins(sorted)
+
+	switch strategy {
+	case LargestFirst:
+		return accumulate(sorted, target)
+	case BranchAndBound:
+		if selected := branchAndBound(sorted, target); selected != nil {
+			return selected, nil
+		}
+		return accumulate(sorted, target)
+	case RandomCoins:
+		rand.Shuffle(len(sorted), func(i, j int) { sorted[i], sorted[j] = sorted[j], sorted[i] })
+		return accumulate(sorted, target)
+	default:
+		return nil, fmt.Errorf("Wallet.SelectCoins: Unknown strategy %d", strategy)
+	}
+}
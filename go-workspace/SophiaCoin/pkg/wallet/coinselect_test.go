@@ -0,0 +1,69 @@
+package wallet
+
+import (
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"testing"
+)
+
+func testCoins(values ...uint64) []Utxo {
+	coins := []Utxo{}
+	for i, value := range values {
+		coins = append(coins, Utxo{TxIn: *pri.NewTxIn(pri.HashResult{byte(i)}, 0), Value: value})
+	}
+	return coins
+}
+
+func total(coins []Utxo) uint64 {
+	var sum uint64 = 0
+	for _, coin := range coins {
+		sum += coin.Value
+	}
+	return sum
+}
+
+func TestSelectCoins(t *testing.T) {
+	coins := testCoins(5, 50, 20, 30, 7)
+
+	selected, err := SelectCoins(coins, 60, LargestFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Value != 50 || selected[1].Value != 30 {
+		t.Fatal("largest first does not take the largest coins")
+	}
+
+	// 50+5+7 leaves no change, 50+20 would
+	selected, err = SelectCoins(coins, 62, BranchAndBound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total(selected) != 62 {
+		t.Fatalf("branch and bound found %d instead of an exact match", total(selected))
+	}
+	selected, err = SelectCoins(coins, 111, BranchAndBound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total(selected) < 111 {
+		t.Fatal("branch and bound does not fall back without an exact match")
+	}
+
+	for i := 0; i < 10; i++ {
+		selected, err = SelectCoins(coins, 100, RandomCoins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total(selected) < 100 {
+			t.Fatal("random selection does not cover the target")
+		}
+	}
+	if coins[0].Value != 5 {
+		t.Fatal("the coins are changed")
+	}
+
+	for _, strategy := range []CoinSelection{LargestFirst, BranchAndBound, RandomCoins} {
+		if _, err := SelectCoins(coins, 113, strategy); err == nil {
+			t.Fatal("selected coins beyond the balance")
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package wallet
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"os"
 	"os-project/SophiaCoin/pkg/crypto"
 	pri "os-project/SophiaCoin/pkg/primitives"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +26,20 @@ type Wallet struct {
 	pubs       map[string]*crypto.PublicKey
 	headers    []*pri.BlockHeader
 	tx_history dataframe.DataFrame
+	sent       map[pri.HashResult]*SentTx
+	received   map[pri.TxIn]*Utxo // outputs paying the keys, spent or not
+	spent      map[pri.TxIn]int   // outpoint -> height of the block spending it
+}
+
+// A transaction broadcast by the wallet, kept until it is seen in a
+// block so that it can be replaced by one paying a higher fee.
+type SentTx struct {
+	Tx     *pri.Transaction
+	Hash   pri.HashResult
+	Key    string // the name of the key receiving the change
+	Change int    // the index of the change output, -1 if there is none
+	Fee    uint64
+	Time   time.Time
 }
 
 type TxRecord struct {
@@ -36,6 +52,7 @@ type TxRecord struct {
 	Amount      int
 	Address     string
 	merkleProof []pri.HashResult
+	tx          *pri.Transaction // proven by merkleProof
 }
 
 var (
@@ -56,6 +73,11 @@ func NewWallet(dir string) *Wallet {
 		keys:    map[string]*crypto.Key{},
 		pubs:    map[string]*crypto.PublicKey{},
 		headers: []*pri.BlockHeader{pri.GetGenesisBlock().GetHeader()},
+		sent:    map[pri.HashResult]*SentTx{},
+
+		received: map[pri.TxIn]*Utxo{},
+		spent:    map[pri.TxIn]int{},
+
 		tx_history: dataframe.New(
 			series.New([]int{}, series.Int, BlockHeight),
 			series.New([]string{}, series.String, TxHash),
@@ -107,7 +129,7 @@ func NewWallet(dir string) *Wallet {
 func NewRecord(
 	blockHeight int,
 	blockHash pri.HashResult,
-	txHash pri.HashResult,
+	tx *pri.Transaction,
 	txIdx int,
 	isTxIn bool,
 	inOutIdx int,
@@ -115,6 +137,13 @@ func NewRecord(
 	address string,
 	merkleProof []byte,
 ) TxRecord {
+	// An undecodable proof is kept as nil, AddTxRecords will reject
+	// the record since nil only proves a single-transaction block.
+	proof, err := pri.DecodeProof(merkleProof)
+	if err != nil {
+		proof = nil
+	}
+	txHash := pri.Hash(tx)
 	return TxRecord{
 		BlockHeight: blockHeight,
 		blockhash:   blockHash,
@@ -124,7 +153,8 @@ func NewRecord(
 		InOutIdx:    inOutIdx,
 		Amount:      amount,
 		Address:     address,
-		merkleProof: nil, // TODO
+		merkleProof: proof,
+		tx:          tx,
 	}
 }
 
@@ -161,6 +191,16 @@ func (w *Wallet) UpdateHeaders(from uint32, headers ...*pri.BlockHeader) error {
 			Comparando: int(from),
 		},
 	)
+	for txIn, utxo := range w.received {
+		if utxo.Height >= int(from) {
+			delete(w.received, txIn)
+		}
+	}
+	for txIn, height := range w.spent {
+		if height >= int(from) {
+			delete(w.spent, txIn)
+		}
+	}
 	return nil
 }
 
@@ -179,7 +219,7 @@ func (w *Wallet) AddTxRecords(records ...*TxRecord) {
 
 	// append only valid records
 	for _, record := range records {
-		if record.BlockHeight >= len(w.headers) {
+		if record.BlockHeight < 0 || record.BlockHeight >= len(w.headers) {
 			continue
 		}
 		if !pri.VerifyProof(
@@ -195,6 +235,20 @@ func (w *Wallet) AddTxRecords(records ...*TxRecord) {
 			continue
 		}
 
+		// The amount of an output is taken from the proven transaction,
+		// not from the daemon
+		if record.IsTxIn {
+			if record.InOutIdx < 0 || record.InOutIdx >= len(record.tx.GetTxIns()) {
+				continue
+			}
+		} else {
+			txOuts := record.tx.GetTxOuts()
+			if record.InOutIdx < 0 || record.InOutIdx >= len(txOuts) {
+				continue
+			}
+			record.Amount = int(txOuts[record.InOutIdx].GetValue())
+		}
+
 		df := w.tx_history.Filter(
 			dataframe.F{
 				Colname:    TxHash,
@@ -229,7 +283,200 @@ func (w *Wallet) AddTxRecords(records ...*TxRecord) {
 		w.tx_history = w.tx_history.RBind(
 			dataframe.LoadStructs([]TxRecord{*record}),
 		)
+		delete(w.sent, toHash(record.TxHash))
+
+		if record.IsTxIn {
+			w.spent[record.tx.GetTxIns()[record.InOutIdx]] = record.BlockHeight
+		} else {
+			txIn := *pri.NewTxIn(toHash(record.TxHash), uint32(record.InOutIdx))
+			w.received[txIn] = &Utxo{
+				TxIn:     txIn,
+				Value:    record.tx.GetTxOuts()[record.InOutIdx].GetValue(),
+				Key:      record.Address,
+				Height:   record.BlockHeight,
+				Coinbase: record.TxIdx == 0,
+			}
+		}
+	}
+}
+
+// The function returns the outputs paying the key that are neither spent
+// on the chain nor by a transaction the wallet has sent, leaving out the
+// coinbase outputs the next block cannot spend yet. You should hold the
+// lock before calling this function.
+func (w *Wallet) getUtxos(name string) []Utxo {
+	pending := map[pri.TxIn]bool{}
+	for _, sent := range w.sent {
+		for _, txIn := range sent.Tx.GetTxIns() {
+			pending[txIn] = true
+		}
+	}
+
+	utxos := []Utxo{}
+	for txIn, utxo := range w.received {
+		if _, ok := w.spent[txIn]; ok || pending[txIn] || utxo.Key != name {
+			continue
+		}
+		if utxo.Coinbase && len(w.headers)-utxo.Height < int(pri.COINBASE_MATURITY) {
+			continue
+		}
+		utxos = append(utxos, *utxo)
+	}
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Height != utxos[j].Height {
+			return utxos[i].Height < utxos[j].Height
+		}
+		a, b := utxos[i].TxIn.GetTxPtr(), utxos[j].TxIn.GetTxPtr()
+		if c := bytes.Compare(a[:], b[:]); c != 0 {
+			return c < 0
+		}
+		return utxos[i].TxIn.GetIndex() < utxos[j].TxIn.GetIndex()
+	})
+	return utxos
+}
+
+// The function returns the spendable outputs of the key, the oldest first.
+func (w *Wallet) GetUtxos(name string) []Utxo {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.getUtxos(name)
+}
+
+// The function builds and signs a transaction paying amount to the
+// receiver from the outputs of the keys, picked with the given strategy
+// among all of them. The change goes back to the first key, as the first
+// output. The fee of the result can exceed the one asked for if branch
+// and bound leaves no change. It is recorded by AddSent once broadcast.
+func (w *Wallet) ConstructTransaction(names []string, recv *crypto.PublicKey, amount uint64, fee uint64,
+	strategy CoinSelection) (*SentTx, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if len(names) == 0 || recv == nil {
+		return nil, fmt.Errorf("Wallet.ConstructTransaction: Invalid address")
+	}
+	utxos := []Utxo{}
+	for _, name := range names {
+		if w.keys[name] == nil {
+			return nil, fmt.Errorf("Wallet.ConstructTransaction: Invalid address")
+		}
+		utxos = append(utxos, w.getUtxos(name)...)
+	}
+	if amount+fee < amount {
+		return nil, fmt.Errorf("Wallet.ConstructTransaction: Amount and fee overflow")
 	}
+	key := w.keys[names[0]]
+	coins, err := SelectCoins(utxos, amount+fee, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	txIns := []pri.TxIn{}
+	var total uint64 = 0
+	for _, coin := range coins {
+		txIns = append(txIns, coin.TxIn)
+		total += coin.Value
+	}
+	txOuts := []pri.TxOut{}
+	changeIdx := -1
+	change := total - amount - fee
+	if strategy == BranchAndBound && change <= BNB_TOLERANCE {
+		fee += change
+	} else if change > 0 {
+		changeIdx = len(txOuts)
+		txOuts = append(txOuts, *pri.NewTxOut(change, key.GetPublicKey()))
+	}
+	txOuts = append(txOuts, *pri.NewTxOut(amount, recv))
+
+	// Payments can be replaced by BumpFee
+	tx := pri.NewTx(txIns, txOuts, nil)
+	tx.SetReplaceable()
+	if err := w.signInputs(tx); err != nil {
+		return nil, err
+	}
+	return &SentTx{Tx: tx, Hash: pri.Hash(tx), Key: names[0], Change: changeIdx, Fee: fee}, nil
+}
+
+// The function records a transaction the wallet has broadcast.
+func (w *Wallet) AddSent(sent *SentTx) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sent.Time = time.Now()
+	w.sent[sent.Hash] = sent
+}
+
+// The function returns the transactions broadcast by the wallet
+// and not seen in a block yet, the oldest first.
+func (w *Wallet) GetSent() []*SentTx {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	sent := make([]*SentTx, 0, len(w.sent))
+	for _, tx := range w.sent {
+		sent = append(sent, tx)
+	}
+	sort.Slice(sent, func(i, j int) bool { return sent[i].Time.Before(sent[j].Time) })
+	return sent
+}
+
+// The function builds and signs a transaction replacing the sent one,
+// spending the same outputs and paying the given fee. The difference is
+// taken from its change output. It is recorded by ReplaceSent once
+// broadcast.
+func (w *Wallet) BumpFee(hash pri.HashResult, fee uint64) (*SentTx, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	sent, ok := w.sent[hash]
+	if !ok {
+		return nil, fmt.Errorf("Wallet.BumpFee: Unknown transaction")
+	}
+	if !sent.Tx.IsReplaceable() {
+		return nil, fmt.Errorf("Wallet.BumpFee: The transaction is not replaceable")
+	}
+	if fee <= sent.Fee {
+		return nil, fmt.Errorf("Wallet.BumpFee: The fee must be higher than %d", sent.Fee)
+	}
+	if sent.Change < 0 || sent.Change >= len(sent.Tx.GetTxOuts()) {
+		return nil, fmt.Errorf("Wallet.BumpFee: No change to take the fee from")
+	}
+
+	// The change is reduced, or dropped if it is used up
+	delta := fee - sent.Fee
+	txOuts := append([]pri.TxOut{}, sent.Tx.GetTxOuts()...)
+	changeOut := txOuts[sent.Change]
+	changeIdx := sent.Change
+	if changeOut.GetValue() < delta {
+		return nil, fmt.Errorf("Wallet.BumpFee: The change %d is less than the fee increase", changeOut.GetValue())
+	} else if changeOut.GetValue() == delta {
+		txOuts = append(txOuts[:changeIdx], txOuts[changeIdx+1:]...)
+		changeIdx = -1
+	} else {
+		txOuts[changeIdx] = *pri.NewTxOut(changeOut.GetValue()-delta, changeOut.GetPubKey())
+	}
+
+	tx := pri.NewTx(sent.Tx.GetTxIns(), txOuts, nil)
+	tx.SetReplaceable()
+	if err := w.signInputs(tx); err != nil {
+		return nil, err
+	}
+	return &SentTx{Tx: tx, Hash: pri.Hash(tx), Key: sent.Key, Change: changeIdx, Fee: fee}, nil
+}
+
+// The function records that the sent transaction has been replaced.
+func (w *Wallet) ReplaceSent(hash pri.HashResult, replacement *SentTx) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sent, ok := w.sent[hash]
+	if !ok {
+		return
+	}
+	delete(w.sent, hash)
+	replacement.Time = sent.Time
+	w.sent[replacement.Hash] = replacement
 }
 
 func (w *Wallet) GetBalance() *map[string]int {
@@ -329,26 +576,51 @@ func (w *Wallet) GetTxHistory() *dataframe.DataFrame {
 	return &w.tx_history
 }
 
-func (w *Wallet) SignTransaction(tx *pri.Transaction, addr string) error {
+// The function signs each input of the transaction with the key owning
+// the output it spends, replacing any signature it has.
+func (w *Wallet) SignTransaction(tx *pri.Transaction) error {
 	w.lock.RLock()
 	defer w.lock.RUnlock()
 
-	key := w.keys[addr]
-	if key == nil {
-		return fmt.Errorf("Wallet.SignTransaction: Invalid address")
-	}
+	return w.signInputs(tx)
+}
 
-	tx.Sign(key)
+// The function returns the key owning the output, or nil if the
+// wallet has no record of it. You should hold the lock before calling
+// this function.
+func (w *Wallet) ownerOf(txIn pri.TxIn) *crypto.Key {
+	utxo, ok := w.received[txIn]
+	if !ok {
+		return nil
+	}
+	return w.keys[utxo.Key]
+}
 
+// You should hold the lock before calling this function.
+func (w *Wallet) signInputs(tx *pri.Transaction) error {
+	keys := []*crypto.Key{}
 	pubs := []*crypto.PublicKey{}
-	for range tx.GetTxIns() {
+	for _, txIn := range tx.GetTxIns() {
+		key := w.ownerOf(txIn)
+		if key == nil {
+			return fmt.Errorf("Wallet.SignTransaction: No key for input %x:%d", txIn.GetTxPtr(), txIn.GetIndex())
+		}
+		keys = append(keys, key)
 		pubs = append(pubs, key.GetPublicKey())
 	}
+	if len(keys) == 0 {
+		return fmt.Errorf("Wallet.SignTransaction: No inputs")
+	}
 
+	unsigned := pri.NewTx(tx.GetTxIns(), tx.GetTxOuts(), nil)
+	if tx.IsReplaceable() {
+		unsigned.SetReplaceable()
+	}
+	*tx = *unsigned
+	tx.Sign(keys...)
 	if !tx.VerifySignature(pubs) {
 		return fmt.Errorf("Wallet.SignTransaction: Invalid signature")
 	}
-
 	return nil
 }
 
@@ -0,0 +1,140 @@
+package wallet
+
+import (
+	"os-project/SophiaCoin/pkg/crypto"
+	pri "os-project/SophiaCoin/pkg/primitives"
+	"testing"
+)
+
+func TestMultiKeySigning(t *testing.T) {
+	w := NewWallet(t.TempDir())
+	for _, name := range []string{"alice", "bob"} {
+		if err := w.NewKey(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range []string{"alice", "bob"} {
+		txIn := *pri.NewTxIn(pri.HashResult{byte(i)}, 0)
+		w.received[txIn] = &Utxo{TxIn: txIn, Value: 100, Key: name, Height: 1}
+	}
+	recv, err := crypto.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.ConstructTransaction([]string{"alice"}, recv.GetPublicKey(), 150, 10, LargestFirst); err == nil {
+		t.Fatal("paid more than the balance of the key")
+	}
+	if _, err := w.ConstructTransaction([]string{"alice", "bob"}, recv.GetPublicKey(), ^uint64(0), 10, LargestFirst); err == nil {
+		t.Fatal("accepted an amount and fee overflowing")
+	}
+	payment, err := w.ConstructTransaction([]string{"alice", "bob"}, recv.GetPublicKey(), 150, 10, LargestFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := payment.Tx
+	if payment.Fee != 10 || len(tx.GetTxIns()) != 2 {
+		t.Fatal("the payment does not spend the outputs of both keys")
+	}
+	change := tx.GetTxOuts()[0]
+	if change.GetValue() != 40 || !change.GetPubKey().Equal(w.keys["alice"].GetPublicKey()) {
+		t.Fatal("the change does not go back to the first key")
+	}
+
+	pubs := []*crypto.PublicKey{}
+	for _, txIn := range tx.GetTxIns() {
+		pubs = append(pubs, w.keys[w.received[txIn].Key].GetPublicKey())
+	}
+	if !tx.VerifySignature(pubs) {
+		t.Fatal("the inputs are not signed by the keys owning them")
+	}
+
+	// Signing again replaces the signatures
+	if err := w.SignTransaction(tx); err != nil || !tx.VerifySignature(pubs) {
+		t.Fatal("the transaction cannot be signed again")
+	}
+	unknown := pri.NewTx([]pri.TxIn{*pri.NewTxIn(pri.HashResult{9}, 0)}, tx.GetTxOuts(), nil)
+	if err := w.SignTransaction(unknown); err == nil {
+		t.Fatal("signed an input of an unknown output")
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	w := NewWallet(t.TempDir())
+	if err := w.NewKey("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		txIn := *pri.NewTxIn(pri.HashResult{byte(i)}, 0)
+		w.received[txIn] = &Utxo{TxIn: txIn, Value: 100, Key: "alice", Height: 1}
+	}
+	self := w.keys["alice"].GetPublicKey()
+
+	// Paying our own key, the payment is not taken for the change
+	exact, err := w.ConstructTransaction([]string{"alice"}, self, 90, 10, BranchAndBound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.AddSent(exact)
+	if _, err := w.BumpFee(exact.Hash, 20); err == nil {
+		t.Fatal("took the fee increase from the payment")
+	}
+
+	payment, err := w.ConstructTransaction([]string{"alice"}, self, 30, 10, LargestFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.AddSent(payment)
+	bumped, err := w.BumpFee(payment.Hash, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txOuts := bumped.Tx.GetTxOuts()
+	if bumped.Fee != 25 || txOuts[bumped.Change].GetValue() != 45 || txOuts[1-bumped.Change].GetValue() != 30 {
+		t.Fatal("the fee increase is not taken from the change")
+	}
+	if !bumped.Tx.IsReplaceable() {
+		t.Fatal("the replacement is not replaceable")
+	}
+}
+
+func TestAddTxRecords(t *testing.T) {
+	w := NewWallet(t.TempDir())
+	if err := w.NewKey("alice"); err != nil {
+		t.Fatal(err)
+	}
+	block := pri.NewBlock(pri.Hash(w.headers[0]), 1, w.keys["alice"].GetPublicKey(), 0)
+	if err := w.UpdateHeaders(1, block.GetHeader()); err != nil {
+		t.Fatal(err)
+	}
+	coinbase := &block.GetTransactions()[0]
+	record := func(height int, inOutIdx int, amount int) *TxRecord {
+		r := NewRecord(height, pri.Hash(block.GetHeader()), coinbase, 0, false, inOutIdx, amount, "alice", nil)
+		return &r
+	}
+
+	// Records of an invalid height or output are ignored
+	w.AddTxRecords(record(-1, 0, 1), record(1, 1, 1), record(1, -1, 1))
+	if len(w.received) != 0 {
+		t.Fatal("added a record of an invalid height or output")
+	}
+
+	// The value comes from the transaction, whatever the daemon says
+	w.AddTxRecords(record(1, 0, 1))
+	txIn := *pri.NewTxIn(pri.Hash(coinbase), 0)
+	utxo, ok := w.received[txIn]
+	if !ok || utxo.Value != coinbase.GetTxOuts()[0].GetValue() {
+		t.Fatal("the output is not added with the value of the transaction")
+	}
+
+	// A coinbase output is not spent before it is mature
+	if len(w.GetUtxos("alice")) != 0 {
+		t.Fatal("an immature coinbase output is spendable")
+	}
+	for i := uint32(1); i < pri.COINBASE_MATURITY; i++ {
+		w.headers = append(w.headers, block.GetHeader())
+	}
+	if len(w.GetUtxos("alice")) != 1 {
+		t.Fatal("a mature coinbase output is not spendable")
+	}
+}